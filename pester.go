@@ -3,17 +3,33 @@
 package pester
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,10 +40,27 @@ const (
 	methodPost                = "Post"
 	methodPostForm            = "PostForm"
 	headerKeyContentType      = "Content-Type"
+	headerKeyContentEncoding  = "Content-Encoding"
+	headerKeyAccept           = "Accept"
+	headerKeyAcceptEncoding   = "Accept-Encoding"
+	headerKeyMethodOverride   = "X-HTTP-Method-Override"
+	headerKeyRetryAfter       = "Retry-After"
 	contentTypeFormURLEncoded = "application/x-www-form-urlencoded"
+	contentTypeJSON           = "application/json"
+	contentTypeEventStream    = "text/event-stream"
+	headerKeyLastEventID      = "Last-Event-ID"
+	redacted                  = "[REDACTED]"
 )
 
-//ErrUnexpectedMethod occurs when an http.Client method is unable to be mapped from a calling method in the pester client
+// ResponseAttemptHeader is set on every response returned by pester to the number of the
+// attempt, starting at 1, that the response came from
+const ResponseAttemptHeader = "X-Pester-Attempt"
+
+// ResponseLatencyHeader is set on every response returned by pester to the time, in
+// milliseconds, that the attempt the response came from took to get it
+const ResponseLatencyHeader = "X-Pester-Latency-Ms"
+
+// ErrUnexpectedMethod occurs when an http.Client method is unable to be mapped from a calling method in the pester client
 var ErrUnexpectedMethod = errors.New("unexpected client method, must be one of Do, Get, Head, Post, or PostFrom")
 
 // ErrReadingBody happens when we cannot read the body bytes
@@ -37,6 +70,55 @@ var ErrReadingBody = errors.New("error reading body")
 // ErrReadingRequestBody happens when we cannot read the request body bytes
 var ErrReadingRequestBody = errors.New("error reading request body")
 
+// ErrUnauthorized is logged for a 401 Unauthorized response retried with OnUnauthorized
+var ErrUnauthorized = errors.New("unauthorized, refreshing credentials")
+
+// ErrReadingResponseBody happens when ValidatePostResponseBody cannot read the response body bytes
+var ErrReadingResponseBody = errors.New("error reading response body")
+
+// ErrUnreplayableBody is returned when an attempt fails and NoBufferBody prevents the
+// request body from being replayed for a retry
+var ErrUnreplayableBody = errors.New("request body cannot be replayed for a retry")
+
+// ErrProxyRotationUnsupported is returned when NextProxy is set but the transport is not an *http.Transport
+var ErrProxyRotationUnsupported = errors.New("NextProxy requires an *http.Transport")
+
+// ErrTooManyRedirects is returned when a request is redirected more than MaxRedirects times
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// ErrAdaptiveTimeout is returned for attempts cancelled by AdaptiveTimeout
+var ErrAdaptiveTimeout = errors.New("attempt exceeded its adaptive timeout")
+
+// ErrStreamEnded is returned by StreamSSE when the server answers with a 204 No Content,
+// asking the client not to reconnect
+var ErrStreamEnded = errors.New("server ended the event stream")
+
+// ErrInsecureRedirect is returned when HTTPSOnly prevents a redirect from https to http
+var ErrInsecureRedirect = errors.New("refusing to follow a redirect from https to http")
+
+// ErrInvalidMaxRetries is returned by Validate when MaxRetries is negative
+var ErrInvalidMaxRetries = errors.New("invalid MaxRetries, must be zero or greater")
+
+// ErrInvalidConcurrency is returned by Validate when Concurrency is less than 1
+var ErrInvalidConcurrency = errors.New("invalid Concurrency, must be 1 or greater")
+
+// ErrMissingBackoff is returned by Validate when neither Backoff nor ShouldContinue is set
+var ErrMissingBackoff = errors.New("missing Backoff, must be set unless ShouldContinue is")
+
+// ErrUnsafeConcurrency is returned by Validate when Concurrency is greater than 1 and
+// ConcurrencySafe allows POST requests, which are not idempotent, to be sent more than once
+var ErrUnsafeConcurrency = errors.New("unsafe Concurrency, ConcurrencySafe allows POST requests to be sent concurrently")
+
+// ErrClientPaused is returned for calls made while the client is paused
+var ErrClientPaused = errors.New("client is paused")
+
+// ErrBodyChecksumMismatch is returned when a request body no longer matches the checksum
+// computed for BodyChecksumHeader when it is sent again
+var ErrBodyChecksumMismatch = errors.New("request body does not match its checksum")
+
+// ErrUnknownBackoff is returned by BackoffByName for names that are neither built in nor registered
+var ErrUnknownBackoff = errors.New("unknown backoff strategy")
+
 // Client wraps the http client and exposes all the functionality of the http.Client.
 // Additionally, Client provides pester specific values for handling resiliency.
 type Client struct {
@@ -49,21 +131,509 @@ type Client struct {
 	Timeout       time.Duration
 
 	// pester specific
-	Concurrency    int
+	Concurrency int
+	// ConcurrencySafe reports whether requests using the given HTTP method may be
+	// sent out concurrently. Defaults to DefaultConcurrencySafe when nil.
+	ConcurrencySafe func(method string) bool
+	// MaxConcurrentBodySize, when greater than 0, is the largest request body sent out
+	// concurrently. Calls with a larger body, or one of unknown size, are sent one request
+	// at a time, whatever their method, as racing them would be wasteful.
+	MaxConcurrentBodySize int64
+	// MaxRetries is the number of attempts made for each concurrent request. Both 0 and 1
+	// mean the request is tried once and never retried. Negative values are treated as 0,
+	// but are reported by Validate.
 	MaxRetries     int
 	Backoff        BackoffStrategy
 	KeepLog        bool
 	LogHook        LogHook
 	ContextLogHook ContextLogHook
 
+	// Signer, when set, signs the request before every attempt
+	Signer Signer
+
+	// Recorder, when set, records every attempt, successful or not, with its request and
+	// the status and headers of its response, for reproducing issues. Request bodies are
+	// recorded up to MaxRecordedBody bytes, when they can be read again.
+	Recorder Recorder
+	// MaxRecordedBody is the most bytes of a request body given to Recorder. It defaults
+	// to DefaultMaxRecordedBody when 0.
+	MaxRecordedBody int64
+
+	// LogRequestHeaders stores a copy of the request headers in each ErrEntry.
+	// Authorization and any headers listed in RedactHeaders are redacted.
+	LogRequestHeaders bool
+	RedactHeaders     []string
+
+	// MetadataFromContext, when set, extracts metadata, such as a tenant ID or operation
+	// name, from the context of every logged attempt into the Metadata of its ErrEntry
+	MetadataFromContext func(ctx context.Context) map[string]string
+
+	// HTTPSOnly refuses to follow redirects from https to http. Such redirects return an
+	// error wrapping ErrInsecureRedirect, which is not retried. CheckRedirect, if set, is
+	// still called first.
+	HTTPSOnly bool
+
+	// MaxRedirects, when greater than 0, is the most redirects followed for an attempt,
+	// instead of the http.Client default of 10. Going over it returns an error wrapping
+	// ErrTooManyRedirects, which is not retried. CheckRedirect, if set, is still called for
+	// the redirects within the limit.
+	MaxRedirects int
+
+	// URLRedactor, when set, is applied to URLs before they are stored in an ErrEntry,
+	// including the URL of a *url.Error, ie, to strip tokens from the query.
+	URLRedactor func(string) string
+
+	// ReturnLastResponseOnCancel buffers the body of a failed response before backing off so
+	// that, if the context is cancelled during the backoff, the response returned alongside
+	// the context error still has a readable body. Closing it is then optional as the
+	// underlying connection has already been released. When false, that response is
+	// returned with its body already closed.
+	ReturnLastResponseOnCancel bool
+
+	// ReturnLastResponse buffers the body of every failed response before retrying so that,
+	// when the final attempt fails without a response, ie, with a transport error, the last
+	// response received, such as an earlier 503, is returned alongside the error.
+	ReturnLastResponse bool
+
+	// ShouldContinue, when set, owns the retry decision. It is called after every attempt
+	// with the attempt number, the time elapsed since the call started, and the attempt's
+	// outcome, and returns whether to retry and how long to wait before doing so. It replaces
+	// the default retry conditions and Backoff; MaxRetries still caps the number of attempts.
+	ShouldContinue func(attempt int, elapsed time.Duration, resp *http.Response, err error) (retry bool, wait time.Duration)
+
+	// MirrorTo is a base URL (scheme, host, and an optional path prefix) that a copy of every
+	// call is sent to in the background. Mirrored requests are never retried and do not
+	// affect the result of the call. Their outcome is passed to OnMirrorResponse, if set,
+	// after which the response body is drained and closed.
+	MirrorTo         string
+	OnMirrorResponse func(resp *http.Response, err error)
+
+	// BaseURL, when set, is used to resolve relative URLs, such as Get("/users"),
+	// following RFC 3986. A trailing slash matters: "/users" resolved against
+	// "http://api/v1/" is "http://api/users", while "users" is "http://api/v1/users".
+	BaseURL string
+
+	// NoBufferBody prevents request bodies from being read into memory. Bodies are then
+	// replayed with the request's GetBody or, for seekable bodies, by seeking back to where
+	// they started; such requests are never sent concurrently. Any other body is sent once
+	// and a failed attempt returns an error wrapping ErrUnreplayableBody instead of retrying.
+	NoBufferBody bool
+
+	// CloseCallerBody closes a body passed to Post that implements io.Closer once pester
+	// is done with it, as http.Client.Post does. Without it, that body is left open for the
+	// caller to close. The body of a request passed to Do is always closed exactly once,
+	// even when the call fails before any request is sent.
+	CloseCallerBody bool
+
+	// FinalErrorFunc, when set, replaces the error returned once all attempts of a request
+	// are exhausted. It receives the last response and error, either of which may be nil,
+	// and the number of attempts made.
+	FinalErrorFunc func(lastResp *http.Response, lastErr error, attempts int) error
+
+	// MaxBodyMemory, when greater than 0, is the largest request body kept in memory for
+	// retries. Larger bodies are written to a temporary file that retries read from and
+	// that is removed once all attempts are done.
+	MaxBodyMemory int64
+
+	// RetryIdentityOnGzipError validates gzip encoded GET responses by reading them into
+	// memory. If the body cannot be decoded, the request is tried once more, without
+	// counting towards MaxRetries, with an `Accept-Encoding: identity` header.
+	RetryIdentityOnGzipError bool
+
+	// ValidatePostResponseBody reads the response body of POST requests into memory, so that
+	// a truncated body is retried, like a transport error, rather than returned. It only
+	// applies when the request body can be replayed. The caller gets the in-memory copy of
+	// the body, so this is meant for small responses to idempotent POSTs.
+	ValidatePostResponseBody bool
+
+	// RetryOnEmptyBody reads the response body of GET requests into memory and retries
+	// successful responses, other than 204 No Content, whose body is empty. Once retries run
+	// out, the last, empty, response is returned.
+	RetryOnEmptyBody bool
+
+	// AutoReadWinningBody reads the body of the response a call returns into memory and
+	// closes it before returning, so that the connection is reused even if the caller never
+	// reads or closes the body. The caller reads the in-memory copy, so this is meant for
+	// small responses. An error reading the body fails the call with ErrReadingResponseBody.
+	AutoReadWinningBody bool
+
+	// SingleFlight shares a single call between all concurrent Get calls for the same URL.
+	// The response body is read into memory and every caller gets its own copy of it.
+	SingleFlight bool
+
+	// NextProxy, when set, picks the proxy used for every attempt, allowing each retry to
+	// go through a different proxy. It requires Transport to be nil or an *http.Transport.
+	NextProxy func(attempt int) (*url.URL, error)
+
+	// MaxInFlightCalls, when greater than 0, is the most calls the client makes at once.
+	// Further calls block until one of them returns or their request's context is done.
+	// It must be set before the first call.
+	MaxInFlightCalls int
+
+	// MaxTotalBodyBuffer, when greater than 0, is the most memory, in bytes, that request
+	// bodies buffered for retries may use across all calls of the client. A call whose body
+	// does not fit waits, until other calls are done or its request's context is, before
+	// reading it. The size of a body is known upfront from the request's ContentLength, or,
+	// for Post and PostForm, from the Len method of readers such as a bytes.Buffer or a
+	// strings.Reader; other bodies are accounted for once read. A single body larger than
+	// the budget is still buffered once no other body is.
+	MaxTotalBodyBuffer int64
+
+	// On1xx, when set, is called for every informational response received before the
+	// final response of an attempt, such as 103 Early Hints, with its status code and
+	// headers. 100 Continue responses are reported as well.
+	On1xx func(code int, header http.Header)
+
+	// OnConnReuse, when set, is called for every attempt once it got a connection, with
+	// whether that connection was reused from the pool rather than newly opened. Retries
+	// that keep opening new connections, such as new TLS handshakes, are slower.
+	OnConnReuse func(attempt int, reused bool)
+
+	// OnAttemptResponse, when set, is called before every retry with the response of the
+	// previous attempt, whose body has already been closed, and the request about to be
+	// sent again, so that the request can be changed according to the response, ie, to
+	// echo a session affinity cookie. It is not called for attempts without a response.
+	OnAttemptResponse func(resp *http.Response, nextReq *http.Request)
+
+	// ResponseHook, when set, is called once with the response that a call is about to
+	// return, such as to normalize headers or wrap the body, and its result is returned
+	// instead. An error it returns replaces the error of the call. It is not called for
+	// calls that end without a response.
+	ResponseHook func(resp *http.Response) (*http.Response, error)
+
+	// OnOutcome, when set, is called once at the end of every call with the status code of
+	// the returned response, or 0 without one, the number of attempts made, and whether the
+	// call succeeded, that is returned no error and a status below 400. Unlike the log,
+	// which records every failed attempt, it allows computing the success rate of calls and
+	// how many requests retries add.
+	OnOutcome func(finalStatus int, attempts int, succeeded bool)
+
+	// StartSpan, when set, is called before every attempt with the attempt's context and a
+	// name such as "GET attempt 1", so that each attempt can be traced, ie, as an
+	// OpenTelemetry span. The returned context is used for the attempt, and the returned
+	// function is called once the attempt is done with its error, or a *StatusError for a
+	// response with a status of 400 or more, or nil.
+	StartSpan func(ctx context.Context, name string) (context.Context, func(err error))
+
+	// InitialJitter, when greater than 0, delays the first attempt of every call by a random
+	// duration between 0 and InitialJitter. This spreads out bursts of calls made at the same
+	// time, such as many instances starting at once, and is unrelated to Backoff.
+	InitialJitter time.Duration
+
+	// RememberRateLimits remembers the URLs that answered with a 429 Too Many Requests, and
+	// delays the first attempt of the next calls to them until the time their Retry-After
+	// header asked for, or, without one, Backoff for a first retry, has passed since.
+	RememberRateLimits bool
+
+	// MinInterval is the shortest wait between the attempts of a request, whatever the
+	// Backoff strategy, RetryAfterFunc, or ShouldContinue ask for, such as to not overwhelm
+	// a fragile device. It takes precedence over SetMaxBackoff.
+	MinInterval time.Duration
+
+	// CloseConnectionBetweenRetries sets Close on every retried request, so that it is sent
+	// on a new connection that is closed afterwards, rather than on the connection of the
+	// failed attempt. Behind a load balancer pinning connections to a backend, this lets the
+	// retry reach a different, possibly healthy, backend.
+	CloseConnectionBetweenRetries bool
+
+	// HonorServerConnectionClose remembers hosts that answered with `Connection: close`
+	// and sets Close on the requests sent to them for ServerConnectionCloseWindow
+	// afterwards, so that they are not sent on connections the server is about to close.
+	HonorServerConnectionClose bool
+	// ServerConnectionCloseWindow defaults to DefaultServerConnectionCloseWindow when 0
+	ServerConnectionCloseWindow time.Duration
+
+	// BudgetAwareBackoff, for requests whose context has a deadline, shortens the wait
+	// before a retry so that the retry, estimated to take as long as the attempt before it,
+	// still ends before the deadline. When no such retry fits anymore, the last result is
+	// returned right away instead of waiting for the deadline. It takes precedence over
+	// MinInterval.
+	BudgetAwareBackoff bool
+
+	// OnBackoffStart and OnBackoffEnd, when set, are called before and after every wait
+	// between attempts, with the attempt that was just made, so that time spent waiting can
+	// be told apart from time spent on requests. OnBackoffEnd reports whether the wait was
+	// interrupted by the request's context being done.
+	OnBackoffStart func(attempt int, d time.Duration)
+	OnBackoffEnd   func(attempt int, interrupted bool)
+
+	// LoadHeader is the name of a response header, such as X-Server-Load, holding the server
+	// load as a value between 0.0 and 1.0. When a failed response carries it, the Backoff
+	// before the next attempt is scaled by 1 + load, so a fully loaded server gets twice the
+	// usual wait. Values outside that range are clamped and unparsable ones are ignored.
+	LoadHeader string
+
+	// RetryAfterFunc, when set, is called with every response that is retried to extract
+	// how long the server asked to wait, from whatever header or format it uses. When it
+	// reports ok, that wait replaces Backoff and LoadHeader, but is still capped by
+	// SetMaxBackoff. It is not called for attempts that failed without a response.
+	RetryAfterFunc func(resp *http.Response) (wait time.Duration, ok bool)
+
+	// TreatRedirectRetryAfterAsBackoff stops redirects that come with a Retry-After header,
+	// as sent by some CDNs to throttle clients to a "slow down" page, and retries the
+	// request after the wait the header asks for instead of following the redirect.
+	TreatRedirectRetryAfterAsBackoff bool
+
+	// RetryBudgetRatio, when greater than 0, limits retries across all calls made with the
+	// client to roughly that ratio of the calls made, ie, 0.1 allows one retry for every ten
+	// calls. A burst of up to 10 retries is allowed before the ratio applies.
+	// Once the budget is exhausted, failed attempts are returned without being retried
+	// until enough new calls have been made.
+	RetryBudgetRatio float64
+
+	// MaxServerErrors, when greater than 0, stops retrying a call once that many 5xx
+	// responses have been received across its attempts, even if MaxRetries allows more.
+	MaxServerErrors int
+
+	// MaxTotalAttempts, when greater than 0, caps the attempts of a call across all of its
+	// concurrent requests, which would otherwise be up to Concurrency times MaxRetries. Once
+	// it is reached, no request starts another attempt.
+	MaxTotalAttempts int
+
+	// FatalStatusCodes are response status codes, such as 401 Unauthorized, that make a call
+	// hopeless: the first response with one of them is returned right away, without being
+	// retried, even by ShouldContinue, and every other concurrent request is cancelled.
+	// SelectBest does not wait for the other requests either.
+	FatalStatusCodes []int
+
+	// AggregateConcurrentErrors, when Concurrency is greater than 1, waits for all of the
+	// concurrent requests once the first of them failed with an error, rather than
+	// returning that error right away. A request that succeeds meanwhile is returned
+	// instead, otherwise the call returns a MultiError with the errors of all of them. This
+	// makes failed calls as slow as the slowest of their requests. It does not apply with
+	// SelectBest, which waits for all the requests anyway.
+	AggregateConcurrentErrors bool
+
+	// RetryOnDNSError, which New sets, retries all DNS lookup failures. When false, lookups
+	// that failed because the host does not exist, such as a mistyped domain, are not
+	// retried, while temporary DNS failures still are.
+	RetryOnDNSError bool
+
+	// RetryableStatusCodes are the response status codes that are retried. When nil,
+	// DefaultRetryableStatusCodes is used. A 429 is retried when it is in the set or when
+	// RetryOnHTTP429 is set.
+	RetryableStatusCodes map[int]bool
+
+	// GRPCStatusHeader, when set, is the header, or trailer, carrying the gRPC status code of
+	// gRPC-Web and Connect responses, such as "Grpc-Status". Responses whose status code is
+	// in RetryableGRPCCodes are retried like a retryable HTTP status, even with a 200 OK.
+	// A status sent in a trailer is only known once the body is read, so such responses are
+	// read into memory.
+	GRPCStatusHeader string
+
+	// RetryableGRPCCodes are the gRPC status codes retried when GRPCStatusHeader is set,
+	// such as 14 for UNAVAILABLE and 8 for RESOURCE_EXHAUSTED
+	RetryableGRPCCodes []int
+
+	// RetryErrorPattern, when set, only retries errors whose message matches it, such as
+	// "connection reset by peer". Responses are retried as usual.
+	RetryErrorPattern *regexp.Regexp
+
+	// NoRetryURLPatterns are the URLs, such as of non-idempotent or expensive endpoints,
+	// that are only ever tried once, with a single request, whatever MaxRetries and
+	// Concurrency are. A call is tried once when its URL, resolved against BaseURL, matches
+	// any of them.
+	NoRetryURLPatterns []*regexp.Regexp
+
+	// RetryableError, when set, reports whether an error returned to Retry is retried.
+	// When nil, every error is.
+	RetryableError func(err error) bool
+
+	// RetryOnlyIfNothingWritten, when set, only retries errors of non-idempotent requests,
+	// such as POST and PATCH, when the request cannot have reached the server, such as a
+	// failed DNS lookup or dial, so that a request is never duplicated. Detection is best
+	// effort: any other error, such as a connection reset, is not retried.
+	RetryOnlyIfNothingWritten bool
+
+	// DefaultHeaders are added to every request, unless the request already has a value
+	// for that header, such as one set on a request passed to Do.
+	DefaultHeaders http.Header
+
+	// HostHeader, when set, is sent as the Host header of every request, including those
+	// passed to Do, while the connection still goes to the host of the URL. This allows
+	// routing virtual hosts through a shared ingress addressed by IP.
+	HostHeader string
+
+	// NoRetryHeader, when set, is the name of a request header, such as X-Pester-No-Retry,
+	// that makes a request passed to Do with a true value for it, ie, "true" or "1", be sent
+	// once, without retries or concurrency. The header itself is never sent.
+	NoRetryHeader string
+
+	// BodyChecksumHeader, when set, is the name of a header, such as X-Content-SHA256, that
+	// every attempt is sent with holding the hex encoded SHA-256 checksum of the request
+	// body, so that the server can verify it. The checksum is computed once the body has
+	// been buffered, and every replay of the body is checked against it, failing the attempt
+	// with ErrBodyChecksumMismatch otherwise. Bodies that are not buffered, because of
+	// NoBufferBody, get no checksum.
+	BodyChecksumHeader string
+
+	// AttemptHeader, when set, is the name of a header, such as X-Attempt, set to the attempt
+	// number (starting at 1) on every attempt.
+	AttemptHeader string
+	// RequestIDHeader, when set, is the name of a header, such as X-Request-ID, set to the
+	// CallID found in the ErrEntry of every attempt of the call. An ID already present on a
+	// request passed to Do is kept instead.
+	RequestIDHeader string
+
+	// SelectBest, when set, picks the response returned by a call with a Concurrency above 1.
+	// Instead of returning the first result, the result of every concurrent request is
+	// collected, or as many as arrived within SelectBestWindow of the first one if it is
+	// greater than 0, and SelectBest returns the index of the one to use. This allows a
+	// slightly slower 200 to be preferred over a fast 503. Every other response is closed.
+	SelectBest       func(results []Result) int
+	SelectBestWindow time.Duration
+
+	// AcceptFallbacks are Accept header values to retry with, in order, when a response is
+	// a 406 Not Acceptable. Each of them uses up an attempt, and a 406 is returned as usual
+	// once they have all been tried.
+	AcceptFallbacks []string
+
+	// OnUnauthorized, when set, is called with the request about to be retried after a 401
+	// Unauthorized response, such as to refresh an expired token and set the new one in its
+	// Authorization header. The request is then retried once, right away and without
+	// counting towards MaxRetries; a second 401 is returned as usual. An error it returns
+	// fails the call. It is not called for requests whose body cannot be replayed.
+	OnUnauthorized func(req *http.Request) error
+
+	// MethodOverride tunnels requests through proxies that only allow GET and POST. Requests
+	// passed to Do with any method other than GET, HEAD, or POST, such as PUT, PATCH, or
+	// DELETE, are sent as a POST on every attempt, with the real method in an
+	// X-HTTP-Method-Override header. The server must understand that header.
+	MethodOverride bool
+
+	// RetryIfSlowerThan, when greater than 0, retries a successful attempt that took longer
+	// than it, in the hope that a fresh attempt is faster. The slow response is held on to
+	// and returned instead if that attempt fails or is also slow. Only one such retry is made
+	// per request, and only if MaxRetries allows another attempt and the limits on retries,
+	// such as MaxTotalAttempts, RetryBudgetRatio, and BudgetAwareBackoff, allow it too.
+	RetryIfSlowerThan time.Duration
+
+	// AdaptiveTimeout gives every attempt a timeout for its response headers based on the
+	// latencies of the recent attempts to the same host that got a response below 500: the
+	// AdaptiveTimeoutPercentile of them, times AdaptiveTimeoutMultiplier. Attempts that run
+	// over it are cancelled and fail with an error wrapping ErrAdaptiveTimeout, which is
+	// retried. There is no such timeout until enough latencies are known for the host.
+	AdaptiveTimeout bool
+	// AdaptiveTimeoutPercentile, between 0 and 1, defaults to
+	// DefaultAdaptiveTimeoutPercentile when 0
+	AdaptiveTimeoutPercentile float64
+	// AdaptiveTimeoutMultiplier defaults to DefaultAdaptiveTimeoutMultiplier when 0
+	AdaptiveTimeoutMultiplier float64
+
+	// SuccessReqNum and SuccessRetryNum are the concurrent request and attempt that the
+	// last call returned. They are overwritten by every call, so they race when the client
+	// is shared.
+	//
+	// Deprecated: use DoAttempts, which returns the number of attempts of each call.
 	SuccessReqNum   int
 	SuccessRetryNum int
 
-	wg *sync.WaitGroup
+	// wg tracks every goroutine started by pester, see Wait
+	wg *inFlight
+
+	// paused is accessed atomically, 1 while the client is paused
+	paused int32
 
 	sync.Mutex
 	ErrLog         []ErrEntry
 	RetryOnHTTP429 bool
+	flights        map[string]*flight
+	proxyBase      *http.Transport
+	proxied        *http.Transport
+	// cancelledLosers and completedLosers count, atomically, the concurrent requests that
+	// lost the race and were either cancelled while in flight or came back anyway
+	cancelledLosers int32
+	completedLosers int32
+	// activeAttempts and waitingAttempts count, atomically, the attempts being sent and the
+	// requests waiting to retry, see InFlight
+	activeAttempts  int32
+	waitingAttempts int32
+	// warnedNegativeBackoff is set, atomically, once a negative backoff has been logged
+	warnedNegativeBackoff int32
+	// callSlots is the semaphore for MaxInFlightCalls
+	callSlots chan struct{}
+	// decoders are the response body decoders added with RegisterDecoder, by encoding
+	decoders map[string]func(io.Reader) io.Reader
+	// bodyBuffered is the memory held by buffered request bodies for MaxTotalBodyBuffer,
+	// and bodyBufferFreed is closed when some of it is released
+	bodyBuffered    int64
+	bodyBufferFreed chan struct{}
+	// maxBackoff caps the wait between attempts, see SetMaxBackoff
+	maxBackoff time.Duration
+	// retryBudgetSpent is the number of retries taken from the retry budget that have not
+	// yet been earned back by new calls
+	retryBudgetSpent float64
+	// latencies are the recent latencies of each host for AdaptiveTimeout
+	latencies map[string]*latencyWindow
+	// closingHosts are the times until which requests to each host are sent with Close,
+	// see HonorServerConnectionClose
+	closingHosts map[string]time.Time
+	// rateLimited are the times until which calls to each URL wait, see RememberRateLimits
+	rateLimited map[string]time.Time
+}
+
+// DefaultServerConnectionCloseWindow is how long HonorServerConnectionClose closes the
+// connections to a host by default
+const DefaultServerConnectionCloseWindow = 10 * time.Second
+
+const (
+	// DefaultAdaptiveTimeoutPercentile is the latency percentile used by AdaptiveTimeout
+	DefaultAdaptiveTimeoutPercentile = 0.99
+	// DefaultAdaptiveTimeoutMultiplier is the multiplier used by AdaptiveTimeout
+	DefaultAdaptiveTimeoutMultiplier = 2
+)
+
+// adaptiveTimeoutWindow is the number of recent latencies AdaptiveTimeout keeps per host,
+// and adaptiveTimeoutMinSamples the number it needs before timing attempts out
+const (
+	adaptiveTimeoutWindow     = 100
+	adaptiveTimeoutMinSamples = 20
+)
+
+// latencyWindow holds the last adaptiveTimeoutWindow latencies of a host
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+// retryBudgetBurst is the number of retries RetryBudgetRatio allows before any call is made
+const retryBudgetBurst = 10
+
+// flight is a GET call shared by all callers of the same URL in SingleFlight mode
+type flight struct {
+	done     chan struct{}
+	resp     *http.Response
+	body     []byte
+	attempts int
+	err      error
+}
+
+// StatusError is passed to the function returned by StartSpan for responses with a
+// status code of 400 or more, and returned by StreamSSE for responses it cannot use
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// MultiError is returned by calls with AggregateConcurrentErrors that fail, holding the
+// final error of every concurrent request that failed
+type MultiError []error
+
+// Error implements error
+func (m MultiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d concurrent requests failed: %s", len(m), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors, so that errors.Is and errors.As look at each of them
+func (m MultiError) Unwrap() []error {
+	return m
 }
 
 // ErrEntry is used to provide the LogString() data and is populated
@@ -78,6 +648,21 @@ type ErrEntry struct {
 	Retry   int
 	Attempt int
 	Err     error
+	// CallID is shared by the entries of every attempt of the same call
+	CallID string
+
+	// RequestHeaders is only populated if LogRequestHeaders is set
+	RequestHeaders http.Header
+	// Metadata is only populated if MetadataFromContext is set
+	Metadata map[string]string
+}
+
+// Result is the outcome of one of the concurrent requests of a call, as passed to SelectBest
+type Result struct {
+	Response *http.Response
+	Err      error
+	// Latency is the time from the start of the call until this result was available
+	Latency time.Duration
 }
 
 // result simplifies the channel communication for concurrent request handling
@@ -86,6 +671,14 @@ type result struct {
 	err   error
 	req   int
 	retry int
+	// attempt is the attempt resp came from
+	attempt int
+	// accepted is set when the outcome was not retried, as opposed to retries running out
+	accepted bool
+	// attempts is the number of attempts the request sent
+	attempts int
+	// fatal is set for a response with one of the FatalStatusCodes
+	fatal bool
 }
 
 // params represents all the params needed to run http client calls and pester errors
@@ -97,6 +690,33 @@ type params struct {
 	bodyType string
 	body     io.ReadCloser
 	data     url.Values
+
+	// reqCopied is set once req has been replaced by a copy that pester can modify
+	reqCopied bool
+	// inFlight is set for the call that others are waiting on in SingleFlight mode
+	inFlight bool
+	// bufferResponse reads every response body into memory, retrying read errors
+	bufferResponse bool
+	// roundTrip sends every attempt as a single round trip, for the RoundTripper
+	roundTrip bool
+}
+
+// ownRequest replaces req by a clone, once, so that it can be modified without affecting
+// the request that was passed in by the caller
+func (p *params) ownRequest() {
+	if !p.reqCopied {
+		p.req = p.req.Clone(p.req.Context())
+		p.reqCopied = true
+	}
+}
+
+// closeBody closes the request body, for calls that end before the body is used
+func (p *params) closeBody() {
+	if p.body != nil {
+		p.body.Close()
+	} else if p.req != nil && p.req.Body != nil {
+		p.req.Body.Close()
+	}
 }
 
 var random *rand.Rand
@@ -108,12 +728,13 @@ func init() {
 // New constructs a new DefaultClient with sensible default values
 func New() *Client {
 	return &Client{
-		Concurrency:    DefaultClient.Concurrency,
-		MaxRetries:     DefaultClient.MaxRetries,
-		Backoff:        DefaultClient.Backoff,
-		ErrLog:         DefaultClient.ErrLog,
-		wg:             &sync.WaitGroup{},
-		RetryOnHTTP429: false,
+		Concurrency:     DefaultClient.Concurrency,
+		MaxRetries:      DefaultClient.MaxRetries,
+		Backoff:         DefaultClient.Backoff,
+		ErrLog:          DefaultClient.ErrLog,
+		wg:              &inFlight{},
+		RetryOnHTTP429:  false,
+		RetryOnDNSError: DefaultClient.RetryOnDNSError,
 	}
 }
 
@@ -125,18 +746,71 @@ func NewExtendedClient(hc *http.Client) *Client {
 	return c
 }
 
-// LogHook is used to log attempts as they happen. This function is never called,
-// however, if KeepLog is set to true.
+// LogHook is used to log attempts as they happen. It is called whether or not KeepLog
+// is set, and after ContextLogHook if both are set.
 type LogHook func(e ErrEntry)
 
 // ContextLogHook does the same as LogHook but with passed Context
 type ContextLogHook func(ctx context.Context, e ErrEntry)
 
+// Signer signs outgoing requests. Sign is called before each attempt with the request
+// that is about to be sent, so it must be safe for concurrent use when Concurrency is
+// greater than 1.
+type Signer interface {
+	Sign(*http.Request) error
+}
+
+// Recorder records the attempts of a client. Record is called as every attempt ends, so it
+// must be safe for concurrent use when Concurrency is greater than 1.
+type Recorder interface {
+	Record(attempt RecordedAttempt)
+}
+
+// RecordedAttempt is an attempt, as given to a Recorder. Headers are redacted like logged
+// ones, see RedactHeaders.
+type RecordedAttempt struct {
+	Time    time.Time
+	Request int
+	Attempt int
+	Method  string
+	URL     string
+	Header  http.Header
+	// Body is the start of the request body, up to MaxRecordedBody bytes, or nil if it
+	// could not be read again
+	Body []byte
+	// BodyTruncated is set when the request body was longer than Body
+	BodyTruncated bool
+
+	// StatusCode and ResponseHeader are only set for attempts that got a response
+	StatusCode     int
+	ResponseHeader http.Header
+	Err            error
+	Duration       time.Duration
+}
+
+// DefaultMaxRecordedBody is the most bytes of a request body recorded by default
+const DefaultMaxRecordedBody = 64 << 10
+
 // BackoffStrategy is used to determine how long a retry request should wait until attempted
 type BackoffStrategy func(retry int) time.Duration
 
 // DefaultClient provides sensible defaults
-var DefaultClient = &Client{Concurrency: 1, MaxRetries: 3, Backoff: DefaultBackoff, ErrLog: []ErrEntry{}}
+var DefaultClient = &Client{Concurrency: 1, MaxRetries: 3, Backoff: DefaultBackoff, ErrLog: []ErrEntry{}, RetryOnDNSError: true}
+
+// DefaultRetryableStatusCodes are the status codes retried by clients without
+// RetryableStatusCodes. Other 5xx codes, such as 501 Not Implemented, are permanent.
+var DefaultRetryableStatusCodes = map[int]bool{
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// DefaultConcurrencySafe allows concurrency only for GET and HEAD calls as they
+// should be idempotent
+func DefaultConcurrencySafe(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
 
 // DefaultBackoff always returns 1 second
 func DefaultBackoff(_ int) time.Duration {
@@ -165,6 +839,57 @@ func LinearJitterBackoff(i int) time.Duration {
 	return jitter(i)
 }
 
+// ScheduleBackoff returns a strategy that waits for the given durations in order; the first
+// retry waits durations[0], the second durations[1], and so on. Retries beyond the end of the
+// schedule wait for the last duration. An empty schedule retries immediately.
+func ScheduleBackoff(durations ...time.Duration) BackoffStrategy {
+	schedule := append([]time.Duration(nil), durations...)
+	return func(i int) time.Duration {
+		if len(schedule) == 0 {
+			return 0
+		}
+		if i < 1 {
+			i = 1
+		}
+		if i > len(schedule) {
+			i = len(schedule)
+		}
+		return schedule[i-1]
+	}
+}
+
+var (
+	backoffsMu sync.RWMutex
+	backoffs   = map[string]BackoffStrategy{
+		"default":            DefaultBackoff,
+		"exponential":        ExponentialBackoff,
+		"exponential_jitter": ExponentialJitterBackoff,
+		"linear":             LinearBackoff,
+		"linear_jitter":      LinearJitterBackoff,
+	}
+)
+
+// BackoffByName returns the strategy registered under name, for selecting a strategy from
+// configuration. The built in strategies are "default", "exponential", "exponential_jitter",
+// "linear", and "linear_jitter".
+func BackoffByName(name string) (BackoffStrategy, error) {
+	backoffsMu.RLock()
+	defer backoffsMu.RUnlock()
+	s, ok := backoffs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownBackoff, name)
+	}
+	return s, nil
+}
+
+// RegisterBackoff makes s available to BackoffByName under name, replacing any strategy,
+// including a built in one, registered under the same name
+func RegisterBackoff(name string, s BackoffStrategy) {
+	backoffsMu.Lock()
+	defer backoffsMu.Unlock()
+	backoffs[name] = s
+}
+
 // jitter keeps the +/- 0-33% logic in one place
 func jitter(i int) time.Duration {
 	ms := i * 1000
@@ -182,34 +907,378 @@ func jitter(i int) time.Duration {
 	return time.Duration(ms) * time.Millisecond
 }
 
-// Wait blocks until all pester requests have returned
-// Probably not that useful outside of testing.
+// Validate reports configuration values that pester would otherwise silently adjust, or
+// that contradict each other, returning the first problem found
+func (c *Client) Validate() error {
+	if c.Concurrency < 1 {
+		return ErrInvalidConcurrency
+	}
+	if c.MaxRetries < 0 {
+		return ErrInvalidMaxRetries
+	}
+	if c.Backoff == nil && c.ShouldContinue == nil {
+		return ErrMissingBackoff
+	}
+	if c.Concurrency > 1 && c.ConcurrencySafe != nil && c.ConcurrencySafe(http.MethodPost) {
+		return ErrUnsafeConcurrency
+	}
+	return nil
+}
+
+// Pause makes all new calls return ErrClientPaused without sending any request. Calls
+// already in flight, including their retries, are allowed to finish.
+func (c *Client) Pause() {
+	atomic.StoreInt32(&c.paused, 1)
+}
+
+// Resume allows new calls to be made again after Pause
+func (c *Client) Resume() {
+	atomic.StoreInt32(&c.paused, 0)
+}
+
+// InFlight returns the number of attempts being sent, and the number of requests waiting
+// in backoff before their next attempt, across all the calls of the client right now
+func (c *Client) InFlight() (active int, waiting int) {
+	return int(atomic.LoadInt32(&c.activeAttempts)), int(atomic.LoadInt32(&c.waitingAttempts))
+}
+
+// Wait blocks until all pester requests have returned, including the concurrent requests
+// that lost the race, and their response bodies have been closed.
+// Probably not that useful outside of testing. Calls never wait for the losers of their
+// race, which are cancelled and drained in the background without keeping the program from
+// exiting.
 func (c *Client) Wait() {
 	c.wg.Wait()
 }
 
+// WaitContext is Wait that gives up once ctx is done, returning ctx.Err(), such as for a
+// graceful shutdown with a deadline. It returns nil once all pester requests have returned.
+func (c *Client) WaitContext(ctx context.Context) error {
+	select {
+	case <-c.wg.idle():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// inFlight counts goroutines like a sync.WaitGroup, but can be waited on with a channel,
+// and Add may be called while others are waiting
+type inFlight struct {
+	mu sync.Mutex
+	n  int
+	// idleCh is closed when n drops to 0, and replaced when n rises from 0
+	idleCh chan struct{}
+}
+
+// Add adds delta, which may be negative, to the count
+func (f *inFlight) Add(delta int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.n == 0 && delta > 0 {
+		f.idleCh = make(chan struct{})
+	}
+	f.n += delta
+	if f.n < 0 {
+		panic("pester: negative in-flight count")
+	}
+	if f.n == 0 && f.idleCh != nil {
+		close(f.idleCh)
+		f.idleCh = nil
+	}
+}
+
+// Done decrements the count by one
+func (f *inFlight) Done() {
+	f.Add(-1)
+}
+
+// Wait blocks until the count is 0
+func (f *inFlight) Wait() {
+	<-f.idle()
+}
+
+// idle returns a channel that is closed once the count is 0
+func (f *inFlight) idle() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.idleCh == nil {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return f.idleCh
+}
+
 func (c *Client) copyBody(src io.ReadCloser) ([]byte, error) {
+	defer src.Close()
+
 	b, err := ioutil.ReadAll(src)
 	if err != nil {
 		return nil, ErrReadingRequestBody
 	}
-	src.Close()
 
 	return b, nil
 }
 
-// resetBody resets the Body and GetBody fields of an http.Request to new Readers over
-// the originalBody. This is used to refresh http.Requests that may have had their
-// bodies closed already.
-func resetBody(request *http.Request, originalBody []byte) {
-	request.Body = io.NopCloser(bytes.NewBuffer(originalBody))
-	request.GetBody = func() (io.ReadCloser, error) {
+// spillBody reads src into memory if it fits within MaxBodyMemory. Larger bodies are
+// written to a temporary file instead, which the caller must close and remove.
+func (c *Client) spillBody(src io.ReadCloser) ([]byte, *os.File, error) {
+	defer src.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(src, c.MaxBodyMemory+1))
+	if err != nil {
+		return nil, nil, ErrReadingRequestBody
+	}
+	if int64(len(b)) <= c.MaxBodyMemory {
+		return b, nil, nil
+	}
+
+	f, err := ioutil.TempFile("", "pester-body-")
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = f.Write(b); err == nil {
+		_, err = io.Copy(f, src)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, nil, ErrReadingRequestBody
+	}
+	return nil, f, nil
+}
+
+// bufferBody reads the response body into memory and closes it, replacing it with an
+// in-memory copy. This frees the underlying connection while the body stays readable.
+func bufferBody(resp *http.Response) ([]byte, error) {
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, err
+}
+
+// isGzipped reports whether the response body is, or was before the transport
+// transparently decompressed it, gzip encoded
+func isGzipped(resp *http.Response) bool {
+	return resp.Uncompressed || strings.EqualFold(resp.Header.Get(headerKeyContentEncoding), "gzip")
+}
+
+// validateGzip buffers a gzip encoded response body and reports any error decoding it
+func validateGzip(resp *http.Response) error {
+	// a transparently decompressed body is decoded while it is read
+	b, err := bufferBody(resp)
+	if err != nil || resp.Uncompressed {
+		return err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	_, err = io.Copy(ioutil.Discard, zr)
+	return err
+}
+
+// resetBody resets the Body and GetBody fields of an http.Request to new Readers from
+// getBody. This is used to refresh http.Requests that may have had their
+// bodies closed already. Headers are left untouched, so an `Expect: 100-continue`
+// handshake is redone on every attempt and a rejected body is never uploaded. The
+// Trailer map is left untouched as well, so trailers are sent again after every body,
+// and so are ContentLength and TransferEncoding, so a chunked request stays chunked.
+func resetBody(request *http.Request, getBody func() (io.ReadCloser, error)) error {
+	body, err := getBody()
+	if err != nil {
+		return err
+	}
+	request.Body = body
+	request.GetBody = getBody
+	return nil
+}
+
+// bytesBody provides new Readers over the originalBody
+func bytesBody(originalBody []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
 		return io.NopCloser(bytes.NewBuffer(originalBody)), nil
 	}
 }
 
+// bodyChecksum returns the hex encoded SHA-256 checksum of a body from getBody
+func bodyChecksum(getBody func() (io.ReadCloser, error)) (string, error) {
+	body, err := getBody()
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumBody wraps getBody so that every Reader it provides fails with
+// ErrBodyChecksumMismatch, instead of io.EOF, if what was read does not match checksum
+func checksumBody(getBody func() (io.ReadCloser, error), checksum string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		body, err := getBody()
+		if err != nil {
+			return nil, err
+		}
+		return &checksumReader{ReadCloser: body, hash: sha256.New(), checksum: checksum}, nil
+	}
+}
+
+// checksumReader checks the checksum of a body once it is read to the end
+type checksumReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	checksum string
+}
+
+// Read implements io.Reader
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.checksum {
+		err = ErrBodyChecksumMismatch
+	}
+	return n, err
+}
+
+// fileBody provides new Readers over the whole content of f. The Readers are independent
+// of each other and can be used concurrently.
+func fileBody(f *os.File) (func() (io.ReadCloser, error), int64, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, -1, err
+	}
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(f, 0, size)), nil
+	}, size, nil
+}
+
+// seekBody provides the body again by seeking back to where it started. As every
+// Reader shares the same underlying body, only one of them can be used at a time.
+func seekBody(body io.ReadSeeker) (func() (io.ReadCloser, error), error) {
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return func() (io.ReadCloser, error) {
+		if _, err := body.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(body), nil
+	}, nil
+}
+
+// nopSeekCloser is an ioutil.NopCloser that does not hide the Seek method
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// nopReadCloser is an ioutil.NopCloser whose Reader can be looked at, see bodyLen
+type nopReadCloser struct {
+	io.Reader
+}
+
+func (nopReadCloser) Close() error { return nil }
+
+// nopCloser works like ioutil.NopCloser but keeps seekable bodies seekable
+func nopCloser(body io.Reader) io.ReadCloser {
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		return nopSeekCloser{seeker}
+	}
+	return nopReadCloser{body}
+}
+
+// bodyLen returns the number of bytes left in body when it is known without reading it,
+// as for a bytes.Reader, strings.Reader, or bytes.Buffer, or -1 otherwise
+func bodyLen(body io.Reader) int64 {
+	switch b := body.(type) {
+	case nopSeekCloser:
+		body = b.ReadSeeker
+	case nopReadCloser:
+		body = b.Reader
+	}
+	if l, ok := body.(interface{ Len() int }); ok {
+		return int64(l.Len())
+	}
+	return -1
+}
+
+// onceCloser only closes the underlying body the first time Close is called
+type onceCloser struct {
+	io.ReadCloser
+	once sync.Once
+	err  error
+}
+
+func (b *onceCloser) Close() error {
+	b.once.Do(func() { b.err = b.ReadCloser.Close() })
+	return b.err
+}
+
 // pester provides all the logic of retries, concurrency, backoff, and logging
 func (c *Client) pester(p params) (*http.Response, error) {
+	resp, _, err := c.pesterAttempts(p)
+	return resp, err
+}
+
+// pesterAttempts is pester, also returning the number of attempts sent by the request
+// that the result came from
+func (c *Client) pesterAttempts(p params) (resp *http.Response, attempts int, err error) {
+	// the shared call of SingleFlight is reported by each of the calls waiting on it
+	if c.OnOutcome != nil && !p.inFlight {
+		defer func() { c.outcome(resp, attempts, err) }()
+	}
+
+	// like http.Client.Do, the request body is closed even when no request is sent
+	bodyTaken := false
+	defer func() {
+		if !bodyTaken {
+			p.closeBody()
+		}
+	}()
+
+	if atomic.LoadInt32(&c.paused) == 1 {
+		return nil, 0, ErrClientPaused
+	}
+
+	if c.SingleFlight && p.method == methodGet && !p.inFlight {
+		return c.singleFlight(p)
+	}
+
+	// callID ties together the log entries of every attempt of this call
+	callID, err := newRequestID()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if c.MaxInFlightCalls > 0 {
+		release, err := c.acquireCall(p)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer release()
+	}
+
+	if c.InitialJitter > 0 {
+		if err := c.initialJitter(p); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if c.RetryBudgetRatio > 0 {
+		c.earnRetryBudget()
+	}
+
+	start := time.Now()
 	resultCh := make(chan result)
 	multiplexCh := make(chan result)
 	finishCh := make(chan struct{})
@@ -219,16 +1288,29 @@ func (c *Client) pester(p params) (*http.Response, error) {
 	totalSentRequests.Add(1)
 	defer totalSentRequests.Done()
 	allRequestsBackCh := make(chan struct{})
+	// cleanup is run once all requests are back
+	var cleanup []func()
+	// every goroutine started by pester is tracked by c.wg, so that Wait returns only
+	// once all of them are done, including the late bodies being closed and the cleanup
+	c.wg.Add(1)
 	go func() {
+		defer c.wg.Done()
 		totalSentRequests.Wait()
+		for _, fn := range cleanup {
+			fn()
+		}
 		close(allRequestsBackCh)
 	}()
 
-	// GET calls should be idempotent and can make use
+	// only verbs that are safe to send more than once can make use
 	// of concurrency. Other verbs can mutate and should not
 	// make use of the concurrency feature
 	concurrency := c.Concurrency
-	if p.verb != http.MethodGet {
+	concurrencySafe := c.ConcurrencySafe
+	if concurrencySafe == nil {
+		concurrencySafe = DefaultConcurrencySafe
+	}
+	if !concurrencySafe(p.verb) || concurrency < 1 {
 		concurrency = 1
 	}
 
@@ -240,36 +1322,225 @@ func (c *Client) pester(p params) (*http.Response, error) {
 		c.hc.Jar = c.Jar
 		c.hc.Timeout = c.Timeout
 	}
+	hc := c.hc
 	c.Unlock()
+	if p.req != nil {
+		if override, ok := p.req.Context().Value(httpClientContextKey{}).(*http.Client); ok && override != nil {
+			hc = override
+		}
+	}
 
 	// re-create the http client so we can leverage the std lib
 	httpClient := http.Client{
-		Transport:     c.hc.Transport,
-		CheckRedirect: c.hc.CheckRedirect,
-		Jar:           c.hc.Jar,
-		Timeout:       c.hc.Timeout,
+		Transport:     hc.Transport,
+		CheckRedirect: hc.CheckRedirect,
+		Jar:           hc.Jar,
+		Timeout:       hc.Timeout,
+	}
+
+	if c.MaxRedirects > 0 {
+		httpClient.CheckRedirect = maxRedirects(c.MaxRedirects, httpClient.CheckRedirect)
+	}
+	if c.HTTPSOnly {
+		httpClient.CheckRedirect = httpsOnlyRedirect(httpClient.CheckRedirect)
+	}
+	if c.TreatRedirectRetryAfterAsBackoff {
+		httpClient.CheckRedirect = retryAfterRedirect(httpClient.CheckRedirect)
+	}
+	if p.roundTrip {
+		// the http.Client using the RoundTripper follows redirects and handles cookies itself
+		httpClient.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		httpClient.Jar = nil
+		httpClient.Timeout = 0
+	}
+
+	if c.NextProxy != nil {
+		transport, err := c.proxyTransport(httpClient.Transport)
+		if err != nil {
+			return nil, 0, err
+		}
+		httpClient.Transport = transport
+	}
+
+	if c.BaseURL != "" {
+		if err := c.resolveBaseURL(&p); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if c.RememberRateLimits {
+		if err := c.waitRateLimit(p); err != nil {
+			return nil, 0, err
+		}
 	}
 
 	// if we have a request body, we need to save it for later
 	var (
 		originalBody []byte
-		err          error
+		buffered     bool
+		// getBody provides the body for every attempt. It is nil when there is no body
+		// or when the body cannot be replayed.
+		getBody      func() (io.ReadCloser, error)
+		unreplayable bool
+		// sharedBody is set when all Readers from getBody share the same underlying body
+		sharedBody bool
+		// bodySize is the size of a body that was not buffered in memory, if known
+		bodySize int64 = -1
 	)
 
-	if p.req != nil && p.req.Body != nil && p.body == nil {
-		originalBody, err = c.copyBody(p.req.Body)
-	} else if p.body != nil {
-		originalBody, err = c.copyBody(p.body)
+	// bodyReserved is the part of MaxTotalBodyBuffer held by this call
+	var bodyReserved int64
+	if c.MaxTotalBodyBuffer > 0 && !c.NoBufferBody && (p.body != nil || p.req != nil && p.req.Body != nil) {
+		if p.req != nil && p.req.ContentLength > 0 {
+			bodyReserved = p.req.ContentLength
+		} else if n := bodyLen(p.body); n > 0 {
+			bodyReserved = n
+		}
+		if err := c.acquireBodyBuffer(p, bodyReserved); err != nil {
+			return nil, 0, err
+		}
+		cleanup = append(cleanup, func() { c.releaseBodyBuffer(bodyReserved) })
+	}
+
+	// from here on, the body is closed once it has been read or all attempts are done
+	bodyTaken = true
+	body := p.body
+	bodyFromReq := p.req != nil && p.req.Body != nil && p.body == nil
+	if bodyFromReq {
+		body = p.req.Body
+	}
+	if body != nil && c.NoBufferBody {
+		if bodyFromReq && p.req.GetBody != nil {
+			getBody = p.req.GetBody
+			body.Close()
+		} else if seeker, ok := body.(io.ReadSeeker); ok {
+			getBody, err = seekBody(seeker)
+			sharedBody = true
+			cleanup = append(cleanup, func() { body.Close() })
+		} else {
+			unreplayable = true
+			// the transport closes the body once sent, make sure it is closed if it never is
+			once := &onceCloser{ReadCloser: body}
+			body = once
+			if bodyFromReq {
+				p.ownRequest()
+				p.req.Body = once
+			}
+			cleanup = append(cleanup, func() { once.Close() })
+		}
+	} else if body != nil && c.MaxBodyMemory > 0 {
+		var spilled *os.File
+		originalBody, spilled, err = c.spillBody(body)
+		if spilled != nil {
+			getBody, bodySize, err = fileBody(spilled)
+			cleanup = append(cleanup, func() {
+				spilled.Close()
+				os.Remove(spilled.Name())
+			})
+		} else if err == nil {
+			buffered = true
+			getBody = bytesBody(originalBody)
+		}
+	} else if body != nil {
+		originalBody, err = c.copyBody(body)
+		buffered = true
+		getBody = bytesBody(originalBody)
 	}
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	if c.MaxTotalBodyBuffer > 0 && !c.NoBufferBody {
+		// account for the body as read, which may differ from its ContentLength
+		size := int64(len(originalBody))
+		if !buffered {
+			size = 0
+		}
+		if size < bodyReserved {
+			c.releaseBodyBuffer(bodyReserved - size)
+			bodyReserved = size
+		} else if size > bodyReserved {
+			if err := c.acquireBodyBuffer(p, size-bodyReserved); err != nil {
+				return nil, 0, err
+			}
+			bodyReserved = size
+		}
+	}
+	var checksum string
+	if c.BodyChecksumHeader != "" && getBody != nil && (buffered || bodySize >= 0) {
+		if checksum, err = bodyChecksum(getBody); err != nil {
+			return nil, 0, err
+		}
+		getBody = checksumBody(getBody, checksum)
+	}
+	var (
+		recordedBody      []byte
+		recordedTruncated bool
+	)
+	if c.Recorder != nil && getBody != nil && (buffered || bodySize >= 0) {
+		if recordedBody, recordedTruncated, err = c.recordBody(getBody); err != nil {
+			return nil, 0, err
+		}
+	}
+	// requests using the same underlying body cannot be sent concurrently
+	if unreplayable || sharedBody {
+		concurrency = 1
+	}
+	if c.MaxConcurrentBodySize > 0 && getBody != nil {
+		size := bodySize
+		if buffered {
+			size = int64(len(originalBody))
+		} else if size < 0 && p.req != nil && p.req.ContentLength > 0 {
+			size = p.req.ContentLength
+		}
+		if size < 0 || size > c.MaxConcurrentBodySize {
+			concurrency = 1
+		}
 	}
 
 	// check to make sure that we aren't trying to use an unsupported method
 	switch p.method {
 	case methodDo, methodGet, methodHead, methodPostForm, methodPost:
 	default:
-		return nil, ErrUnexpectedMethod
+		return nil, 0, ErrUnexpectedMethod
+	}
+
+	var requestID string
+	if c.RequestIDHeader != "" {
+		if p.req != nil {
+			requestID = p.req.Header.Get(c.RequestIDHeader)
+		}
+		if requestID == "" {
+			requestID = callID
+		}
+	}
+	if p.req != nil {
+		// headers, signatures and the like are set on every attempt, which must not change the
+		// caller's request
+		p.ownRequest()
+	}
+
+	// a call marked with NoRetryHeader is sent once, and the header is never sent
+	noRetry := false
+	if c.NoRetryHeader != "" && p.req != nil && p.req.Header.Get(c.NoRetryHeader) != "" {
+		if v, err := strconv.ParseBool(p.req.Header.Get(c.NoRetryHeader)); err == nil && v {
+			noRetry = true
+			concurrency = 1
+		}
+		p.ownRequest()
+		p.req.Header.Del(c.NoRetryHeader)
+	}
+	for _, pattern := range c.NoRetryURLPatterns {
+		if pattern.MatchString(p.url) {
+			noRetry = true
+			concurrency = 1
+			break
+		}
+	}
+
+	if c.MethodOverride && p.req != nil && overridesMethod(p.req.Method) {
+		p.ownRequest()
+		p.req.Header.Set(headerKeyMethodOverride, p.req.Method)
+		p.req.Method = http.MethodPost
 	}
 
 	// provideRequest returns an HTTP request to be use when retrying.
@@ -283,20 +1554,40 @@ func (c *Client) pester(p params) (*http.Response, error) {
 		switch p.method {
 		case methodDo:
 			if concurrency > 1 {
+				// Clone deep copies the Header and Trailer maps, so each concurrent
+				// request can be modified (ie, by a Signer) independently of the others.
+				// Every clone shares the caller's context, so cancelling it stops them all.
 				request = p.req.Clone(p.req.Context())
 			} else {
 				request = p.req
 			}
-			if request.Body != nil {
+			if request.Body != nil && getBody != nil {
 				// reset the body since Clone() doesn't do that for us
 				// and we drained it earlier when performing the Copy
 				// ex: https://go.dev/play/p/jlc6A-fjaOi
-				resetBody(request, originalBody)
+				// This also sets GetBody before the first attempt, even if the caller's
+				// request had none, so that 307 and 308 redirects can replay the body.
+				err = resetBody(request, getBody)
 			}
 		case methodGet, methodHead:
 			request, err = http.NewRequest(p.verb, p.url, nil)
 		case methodPostForm, methodPost:
-			request, err = http.NewRequest(http.MethodPost, p.url, bytes.NewBuffer(originalBody))
+			var postBody io.Reader = body
+			if buffered {
+				// known in-memory readers get their ContentLength and GetBody set by NewRequest
+				postBody = bytes.NewBuffer(originalBody)
+			} else if getBody != nil {
+				if postBody, err = getBody(); err != nil {
+					return
+				}
+			}
+			request, err = http.NewRequest(http.MethodPost, p.url, postBody)
+			if err == nil && !buffered && getBody != nil {
+				request.GetBody = getBody
+				if bodySize >= 0 {
+					request.ContentLength = bodySize
+				}
+			}
 		}
 		if err != nil {
 			return
@@ -305,115 +1596,505 @@ func (c *Client) pester(p params) (*http.Response, error) {
 		if len(p.bodyType) > 0 {
 			request.Header.Set(headerKeyContentType, p.bodyType)
 		}
+		for k, v := range c.DefaultHeaders {
+			k = http.CanonicalHeaderKey(k)
+			if _, ok := request.Header[k]; !ok {
+				request.Header[k] = append([]string(nil), v...)
+			}
+		}
+		if requestID != "" {
+			request.Header.Set(c.RequestIDHeader, requestID)
+		}
+		if c.HostHeader != "" {
+			request.Host = c.HostHeader
+		}
+		if checksum != "" {
+			request.Header.Set(c.BodyChecksumHeader, checksum)
+		}
 
 		return
 	}
 
+	// serverErrors counts the 5xx responses of all attempts for MaxServerErrors, atomically
+	var serverErrors int32
+	// totalAttempts counts the attempts of all concurrent requests for MaxTotalAttempts,
+	// atomically, including the one about to be made
+	var totalAttempts int32
+	// reserveAttempt takes one of MaxTotalAttempts for another attempt, reporting whether
+	// there was one left
+	reserveAttempt := func() bool {
+		return c.MaxTotalAttempts <= 0 || atomic.AddInt32(&totalAttempts, 1) <= int32(c.MaxTotalAttempts)
+	}
+
 	AttemptLimit := c.MaxRetries
-	if AttemptLimit <= 0 {
+	if AttemptLimit <= 0 || unreplayable || noRetry {
 		AttemptLimit = 1
 	}
 
+	if c.MirrorTo != "" && (unreplayable || sharedBody) {
+		// the body can only be sent once at a time, so it cannot be mirrored
+		if c.OnMirrorResponse != nil {
+			c.OnMirrorResponse(nil, ErrUnreplayableBody)
+		}
+	} else if c.MirrorTo != "" {
+		mirrorReq, err := provideRequest()
+		if err != nil {
+			return nil, 0, err
+		}
+		// never share the request with the primary attempts
+		mirrorReq = mirrorReq.Clone(context.Background())
+		if mirrorReq.Body != nil {
+			if err := resetBody(mirrorReq, getBody); err != nil {
+				return nil, 0, err
+			}
+		}
+		// the mirrored request reads the same body, so keep it around until it is done
+		totalSentRequests.Add(1)
+		c.mirror(httpClient, mirrorReq, totalSentRequests.Done)
+	}
+
+	// concurrent requests that lose the race are cancelled as soon as there is an accepted
+	// result, see cancelLosers
+	var cancels []context.CancelFunc
+	var hedgeCtxs []context.Context
+	if concurrency > 1 {
+		parent := context.Background()
+		if p.req != nil {
+			parent = p.req.Context()
+		}
+		for n := 0; n < concurrency; n++ {
+			ctx, cancel := context.WithCancel(parent)
+			hedgeCtxs = append(hedgeCtxs, ctx)
+			cancels = append(cancels, cancel)
+		}
+	}
+	// winner is the concurrent request whose result is returned, its context is left to
+	// its response body while all the others are released once they are back
+	winner := -1
+	cleanup = append(cleanup, func() {
+		for n, cancel := range cancels {
+			if n != winner {
+				cancel()
+			}
+		}
+	})
+
+	// workersDoneCh is closed once every concurrent request has sent its result, if any, so
+	// that AggregateConcurrentErrors and SelectBest know when there are no results left to
+	// wait for, as requests over MaxTotalAttempts stop without one
+	var workers sync.WaitGroup
+	var workersDoneCh chan struct{}
+	aggregate := c.AggregateConcurrentErrors && concurrency > 1 && c.SelectBest == nil
+	trackWorkers := aggregate || c.SelectBest != nil && concurrency > 1
+	if trackWorkers {
+		workersDoneCh = make(chan struct{})
+		workers.Add(concurrency)
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			workers.Wait()
+			close(workersDoneCh)
+		}()
+	}
+
 	for n := 0; n < concurrency; n++ {
 		c.wg.Add(1)
 		totalSentRequests.Add(1)
 		go func(n int) {
 			defer c.wg.Done()
 			defer totalSentRequests.Done()
+			if trackWorkers {
+				defer workers.Done()
+			}
 			req, err := provideRequest()
 			// couldn't get a request to use, so don't proceed
 			if err != nil {
 				multiplexCh <- result{err: err, req: n}
 				return
 			}
+			if hedgeCtxs != nil {
+				req = req.WithContext(hedgeCtxs[n])
+			}
+
+			logAttempt := func(i int, err error) {
+				c.log(
+					req.Context(),
+					ErrEntry{
+						Time:    time.Now(),
+						Method:  p.method,
+						Verb:    req.Method,
+						URL:     c.redactURL(req.URL.String()),
+						Request: n,
+						Retry:   i + 1, // would remove, but would break backward compatibility
+						Attempt: i,
+						Err:     c.redactURLError(err),
+						CallID:  callID,
 
-			for i := 1; i <= AttemptLimit; i++ {
-				c.wg.Add(1)
-				defer c.wg.Done()
+						RequestHeaders: c.loggedHeaders(req.Header),
+						Metadata:       c.metadata(req.Context()),
+					},
+				)
+			}
 
+			// attemptLimit may be raised by fallback attempts that don't count towards MaxRetries
+			attemptLimit := AttemptLimit
+			identityFallback := false
+			refreshedAuth := false
+			// acceptFallback is the number of AcceptFallbacks used so far
+			acceptFallback := 0
+			// lastResp is the last failed response kept for ReturnLastResponse
+			var (
+				lastResp    *http.Response
+				lastAttempt int
+			)
+			// slowResp is the response of an attempt that was retried for being slow
+			var (
+				slowResp    *http.Response
+				slowAttempt int
+			)
+			defer func() {
+				if slowResp != nil {
+					discardBody(slowResp)
+				}
+			}()
+			for i := 1; i <= attemptLimit; i++ {
 				select {
 				case <-finishCh:
 					return
 				default:
 				}
+				// the requests that get an attempt always send a result, the others can just stop
+				if i == 1 && !reserveAttempt() {
+					return
+				}
 
-				resp, err := httpClient.Do(req)
-				// Early return if we have a valid result
-				// Only retry (ie, continue the loop) on 5xx status codes and 429
-				if err == nil && resp.StatusCode < http.StatusInternalServerError && (resp.StatusCode != http.StatusTooManyRequests || (resp.StatusCode == http.StatusTooManyRequests && !c.RetryOnHTTP429)) {
-					multiplexCh <- result{resp: resp, err: err, req: n, retry: i}
+				if c.AttemptHeader != "" {
+					req.Header.Set(c.AttemptHeader, strconv.Itoa(i))
+				}
+				if acceptFallback > 0 {
+					req.Header.Set(headerKeyAccept, c.AcceptFallbacks[acceptFallback-1])
+				}
+
+				// signatures frequently include timestamps, so they are redone for every attempt
+				if c.Signer != nil {
+					if err := c.Signer.Sign(req); err != nil {
+						multiplexCh <- result{err: err, req: n, attempts: i - 1}
+						return
+					}
+				}
+
+				if c.HonorServerConnectionClose && c.hostClosing(req.URL.Host) {
+					req.Close = true
+				}
+
+				attemptStart := time.Now()
+				attemptCtx := c.attemptContext(req.Context(), i)
+				var finishSpan func(err error)
+				if c.StartSpan != nil {
+					attemptCtx, finishSpan = c.StartSpan(attemptCtx, fmt.Sprintf("%s attempt %d", req.Method, i))
+				}
+				var (
+					resp *http.Response
+					err  error
+				)
+				atomic.AddInt32(&c.activeAttempts, 1)
+				if timeout := c.adaptiveTimeout(req.URL.Host); timeout > 0 {
+					resp, err = c.doWithTimeout(&httpClient, req.WithContext(attemptCtx), timeout)
+				} else {
+					resp, err = httpClient.Do(req.WithContext(attemptCtx))
+				}
+				atomic.AddInt32(&c.activeAttempts, -1)
+				latency := time.Since(attemptStart)
+				if resp != nil {
+					if resp.Header == nil {
+						resp.Header = http.Header{}
+					}
+					resp.Header.Set(ResponseLatencyHeader, strconv.FormatInt(int64(latency/time.Millisecond), 10))
+				}
+				if c.AdaptiveTimeout && err == nil && resp.StatusCode < 500 {
+					c.recordLatency(req.URL.Host, latency)
+				}
+				if c.HonorServerConnectionClose && err == nil && resp.Close {
+					c.closeHost(req.URL.Host)
+				}
+				if c.RememberRateLimits && err == nil && resp.StatusCode == http.StatusTooManyRequests {
+					c.rememberRateLimit(p.url, resp)
+				}
+				if finishSpan != nil {
+					finishSpan(spanError(resp, err))
+				}
+				if c.Recorder != nil {
+					attempt := RecordedAttempt{
+						Time:          attemptStart,
+						Request:       n,
+						Attempt:       i,
+						Method:        req.Method,
+						URL:           c.redactURL(req.URL.String()),
+						Header:        c.redactHeaders(req.Header),
+						Body:          recordedBody,
+						BodyTruncated: recordedTruncated,
+						Err:           c.redactURLError(err),
+						Duration:      time.Since(attemptStart),
+					}
+					if resp != nil {
+						attempt.StatusCode = resp.StatusCode
+						attempt.ResponseHeader = c.redactHeaders(resp.Header)
+					}
+					c.Recorder.Record(attempt)
+				}
+				if err != nil && hedgeCtxs != nil && hedgeCtxs[n].Err() != nil && finished(finishCh) {
+					// another request won while this one was in flight
+					atomic.AddInt32(&c.cancelledLosers, 1)
 					return
 				}
 
-				loggingContext := req.Context()
-				c.log(
-					loggingContext,
-					ErrEntry{
-						Time:    time.Now(),
-						Method:  p.method,
-						Verb:    req.Method,
-						URL:     req.URL.String(),
-						Request: n,
-						Retry:   i + 1, // would remove, but would break backward compatibility
-						Attempt: i,
-						Err:     err,
-					},
+				// a proxy may have corrupted the compressed body, so try once more without compression,
+				// unless the call is out of attempts and the response is returned as it is
+				if err == nil && c.RetryIdentityOnGzipError && !identityFallback && req.Method == http.MethodGet && isGzipped(resp) {
+					if gzipErr := validateGzip(resp); gzipErr != nil && reserveAttempt() {
+						logAttempt(i, gzipErr)
+						identityFallback = true
+						attemptLimit++
+						req.Header.Set(headerKeyAcceptEncoding, "identity")
+						if req.Body != nil && getBody != nil {
+							if err := resetBody(req, getBody); err != nil {
+								multiplexCh <- result{err: err, req: n, attempts: i}
+								return
+							}
+						}
+						continue
+					}
+				}
+
+				// the token may just have expired, so try once more after refreshing it, unless the
+				// call is out of attempts
+				if err == nil && resp.StatusCode == http.StatusUnauthorized && c.OnUnauthorized != nil && !refreshedAuth && !unreplayable &&
+					reserveAttempt() {
+					discardBody(resp)
+					logAttempt(i, ErrUnauthorized)
+					if err := c.OnUnauthorized(req); err != nil {
+						multiplexCh <- result{err: err, req: n, attempts: i}
+						return
+					}
+					refreshedAuth = true
+					attemptLimit++
+					if req.Body != nil && getBody != nil {
+						if err := resetBody(req, getBody); err != nil {
+							multiplexCh <- result{err: err, req: n, attempts: i}
+							return
+						}
+					}
+					continue
+				}
+
+				// the status may be fine while the body is cut short, so read it before deciding
+				emptyBody := false
+				if err == nil && (p.bufferResponse || c.ValidatePostResponseBody && !unreplayable && req.Method == http.MethodPost ||
+					c.RetryOnEmptyBody && req.Method == http.MethodGet || c.grpcStatusInTrailer(resp)) {
+					b, bodyErr := bufferBody(resp)
+					if bodyErr == nil {
+						b, bodyErr = c.decodeBody(resp, b)
+					}
+					if bodyErr != nil {
+						resp, err = nil, fmt.Errorf("%w: %v", ErrReadingResponseBody, bodyErr)
+					}
+					emptyBody = bodyErr == nil && len(b) == 0
+				}
+
+				var (
+					retry bool
+					wait  time.Duration
 				)
+				if c.ShouldContinue != nil {
+					retry, wait = c.ShouldContinue(i, time.Since(start), resp, err)
+				} else {
+					retry = c.retryable(p.verb, resp, err)
+					if !retry && err == nil && resp.StatusCode == http.StatusNotAcceptable && acceptFallback < len(c.AcceptFallbacks) {
+						retry = true
+						acceptFallback++
+					}
+					if !retry && emptyBody && c.RetryOnEmptyBody && resp.StatusCode/100 == 2 && resp.StatusCode != http.StatusNoContent {
+						retry = true
+					}
+				}
 
-				// if it is the last iteration, grab the result (which is an error at this point)
-				if i == AttemptLimit {
-					multiplexCh <- result{resp: resp, err: err}
+				// a fatal status stops every concurrent request, whatever was decided above
+				fatal := err == nil && c.fatalStatus(resp.StatusCode)
+				if fatal {
+					retry = false
+				}
+
+				if c.RetryIfSlowerThan > 0 && !fatal {
+					slow := time.Since(attemptStart) > c.RetryIfSlowerThan
+					if slowResp != nil {
+						// this was the retry of a slow attempt, fall back to that attempt
+						// unless this one did better
+						if retry || slow {
+							if resp != nil {
+								discardBody(resp)
+							}
+							multiplexCh <- result{resp: slowResp, req: n, attempts: i, retry: slowAttempt, attempt: slowAttempt, accepted: true}
+							slowResp = nil
+							return
+						}
+						discardBody(slowResp)
+						slowResp = nil
+					} else if slow && !retry && err == nil && i < attemptLimit &&
+						(!c.BudgetAwareBackoff || fitsDeadline(req.Context(), time.Since(attemptStart))) &&
+						reserveAttempt() && (c.RetryBudgetRatio <= 0 || c.spendRetryBudget()) {
+						// the slow retry is limited like any other, or the slow response is accepted
+						slowResp, slowAttempt = resp, i
+						logAttempt(i, fmt.Errorf("attempt took %s, longer than RetryIfSlowerThan", time.Since(attemptStart)))
+						if req.Body != nil && getBody != nil {
+							if err := resetBody(req, getBody); err != nil {
+								multiplexCh <- result{err: err, req: n, attempts: i}
+								return
+							}
+						}
+						continue
+					}
+				}
+
+				// Early return if we have a valid result
+				if !retry {
+					multiplexCh <- result{resp: resp, err: err, req: n, attempts: i, retry: i, attempt: i, accepted: true, fatal: fatal}
+					return
+				}
+
+				logAttempt(i, err)
+
+				// if it is the last iteration, the server seems broken, the call is out of
+				// attempts, or retries have been throttled, grab the result (which is an error
+				// at this point)
+				attemptTook := time.Since(attemptStart)
+				if i == attemptLimit ||
+					(c.BudgetAwareBackoff && !fitsDeadline(req.Context(), attemptTook)) ||
+					(c.MaxServerErrors > 0 && resp != nil && resp.StatusCode >= 500 && atomic.AddInt32(&serverErrors, 1) >= int32(c.MaxServerErrors)) ||
+					!reserveAttempt() ||
+					(c.RetryBudgetRatio > 0 && !c.spendRetryBudget()) {
+					respAttempt := i
+					if resp == nil && lastResp != nil {
+						resp, respAttempt = lastResp, lastAttempt
+					}
+					if unreplayable {
+						err = unreplayableError(err)
+					}
+					if c.FinalErrorFunc != nil {
+						err = c.FinalErrorFunc(resp, err, i)
+					}
+					multiplexCh <- result{resp: resp, err: err, req: n, attempts: i, attempt: respAttempt}
 					return
 				}
 
 				//If the request has been cancelled, skip retries
 				select {
 				case <-req.Context().Done():
-					multiplexCh <- result{resp: resp, err: req.Context().Err()}
+					multiplexCh <- result{resp: resp, err: req.Context().Err(), req: n, attempts: i, attempt: i}
 					return
 				default:
 				}
 
 				// if we are retrying, we should close this response body to free the fd
 				if resp != nil {
-					resp.Body.Close()
+					if c.ReturnLastResponseOnCancel || c.ReturnLastResponse {
+						// hold on to a copy of the body in case we are cancelled during backoff
+						// or the next attempts don't get a response
+						bufferBody(resp)
+					} else {
+						resp.Body.Close()
+					}
+					if c.ReturnLastResponse {
+						lastResp, lastAttempt = resp, i
+					}
 				}
 
+				if c.ShouldContinue == nil {
+					wait = c.backoff(i, resp)
+				}
+				if wait < 0 && atomic.CompareAndSwapInt32(&c.warnedNegativeBackoff, 0, 1) {
+					// make the wait of a misbehaving strategy visible once in the log
+					logAttempt(i, fmt.Errorf("negative backoff of %s, waiting 0 instead", wait))
+				}
+				wait = c.clampBackoff(wait)
+				if c.BudgetAwareBackoff {
+					// leave enough time for the next attempt to be as fast as this one
+					if deadline, ok := req.Context().Deadline(); ok {
+						if budget := time.Until(deadline) - attemptTook; wait > budget {
+							wait = budget
+						}
+					}
+				}
+
+				if c.OnBackoffStart != nil {
+					c.OnBackoffStart(i, wait)
+				}
+				atomic.AddInt32(&c.waitingAttempts, 1)
 				select {
 				// prevent a 0 from causing the tick to block, pass additional microsecond
-				case <-time.After(c.Backoff(i) + 1*time.Microsecond):
+				case <-time.After(wait + 1*time.Microsecond):
+					atomic.AddInt32(&c.waitingAttempts, -1)
+					if c.OnBackoffEnd != nil {
+						c.OnBackoffEnd(i, false)
+					}
 				// allow context cancellation to cancel during backoff
 				case <-req.Context().Done():
-					multiplexCh <- result{resp: resp, err: req.Context().Err()}
+					atomic.AddInt32(&c.waitingAttempts, -1)
+					if c.OnBackoffEnd != nil {
+						c.OnBackoffEnd(i, true)
+					}
+					multiplexCh <- result{resp: resp, err: req.Context().Err(), req: n, attempts: i, attempt: i}
 					return
 				}
 
+				if c.OnAttemptResponse != nil && resp != nil {
+					c.OnAttemptResponse(resp, req)
+				}
+				if c.CloseConnectionBetweenRetries {
+					req.Close = true
+				}
+
 				// we are about to retry, if we had a Body, we will need to restore it
 				// to a non-closed one in order to work reliably. If you do not do this,
 				// there are a number of curious edge cases depending on the type of the
 				// underlying reader: https://go.dev/play/p/gZLVUe2EXSE
-				if req.Body != nil {
-					resetBody(req, originalBody)
+				if req.Body != nil && getBody != nil {
+					if err := resetBody(req, getBody); err != nil {
+						multiplexCh <- result{err: err, req: n, attempts: i}
+						return
+					}
 				}
 			}
 		}(n)
 	}
 
 	// spin off the go routine so it can continually listen in on late results and close the response bodies
+	c.wg.Add(1)
 	go func() {
+		defer c.wg.Done()
 		gotFirstResult := false
+		if c.SelectBest != nil && concurrency > 1 {
+			// wait for the other requests before letting them know they can stop retrying
+			gotFirstResult = true
+			res := c.selectBest(multiplexCh, workersDoneCh, concurrency, start)
+			close(finishCh)
+			winner = res.req
+			resultCh <- cancelLosers(res, cancels)
+		}
 		for {
 			select {
 			case res := <-multiplexCh:
 				if !gotFirstResult {
 					gotFirstResult = true
+					if aggregate && res.err != nil {
+						res = aggregateErrors(res, multiplexCh, workersDoneCh)
+					}
 					close(finishCh)
-					resultCh <- res
+					winner = res.req
+					resultCh <- cancelLosers(res, cancels)
 				} else if res.resp != nil {
 					// we only return one result to the caller; close all other response bodies that come back
-					// drain the body before close as to not prevent keepalive. see https://gist.github.com/mholt/eba0f2cc96658be0f717
-					io.Copy(ioutil.Discard, res.resp.Body)
-					res.resp.Body.Close()
+					atomic.AddInt32(&c.completedLosers, 1)
+					discardBody(res.resp)
 				}
 			case <-allRequestsBackCh:
 				// don't leave this goroutine running
@@ -424,119 +2105,1502 @@ func (c *Client) pester(p params) (*http.Response, error) {
 
 	res := <-resultCh
 	c.Lock()
-	defer c.Unlock()
 	c.SuccessReqNum = res.req
 	c.SuccessRetryNum = res.retry
+	c.Unlock()
+
+	if res.resp != nil && res.attempt > 0 {
+		if res.resp.Header == nil {
+			res.resp.Header = http.Header{}
+		}
+		res.resp.Header.Set(ResponseAttemptHeader, strconv.Itoa(res.attempt))
+	}
+
+	if res.resp != nil && c.AutoReadWinningBody {
+		if _, err := bufferBody(res.resp); err != nil {
+			return nil, res.attempts, fmt.Errorf("%w: %v", ErrReadingResponseBody, err)
+		}
+	}
+
+	if res.resp != nil && c.ResponseHook != nil {
+		resp, err := c.ResponseHook(res.resp)
+		if err != nil {
+			return resp, res.attempts, err
+		}
+		res.resp = resp
+	}
 
-	return res.resp, res.err
+	return res.resp, res.attempts, res.err
 }
 
-// LogString provides a string representation of the errors the client has seen
-func (c *Client) LogString() string {
-	c.Lock()
-	defer c.Unlock()
-	var res string
-	for _, e := range c.ErrLog {
-		res += c.FormatError(e)
+// outcome reports the end of a call to OnOutcome
+func (c *Client) outcome(resp *http.Response, attempts int, err error) {
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	c.OnOutcome(status, attempts, err == nil && status > 0 && status < 400)
+}
+
+// selectBest collects the results of up to n concurrent requests, until workersDoneCh is
+// closed, and returns the one picked by SelectBest
+func (c *Client) selectBest(multiplexCh chan result, workersDoneCh chan struct{}, n int, start time.Time) result {
+	var (
+		results []result
+		best    []Result
+		window  <-chan time.Time
+	)
+collect:
+	for len(results) < n {
+		select {
+		case res := <-multiplexCh:
+			if res.fatal {
+				// there is no point in waiting for anything better
+				for _, other := range results {
+					if other.resp != nil {
+						discardBody(other.resp)
+					}
+				}
+				return res
+			}
+			results = append(results, res)
+			best = append(best, Result{Response: res.resp, Err: res.err, Latency: time.Since(start)})
+			if window == nil && c.SelectBestWindow > 0 {
+				timer := time.NewTimer(c.SelectBestWindow)
+				defer timer.Stop()
+				window = timer.C
+			}
+		case <-window:
+			break collect
+		case <-workersDoneCh:
+			// every result was received before its request was done
+			break collect
+		}
+	}
+
+	i := c.SelectBest(best)
+	if i < 0 || i >= len(results) {
+		i = 0
+	}
+	for j, res := range results {
+		if j != i && res.resp != nil {
+			discardBody(res.resp)
+		}
+	}
+	return results[i]
+}
+
+// aggregateErrors waits for the results of the other concurrent requests after res
+// failed, returning the first of them without an error, if any, or res with the errors
+// of all of them otherwise
+func aggregateErrors(res result, multiplexCh chan result, workersDoneCh chan struct{}) result {
+	errs := MultiError{res.err}
+	for {
+		select {
+		case other := <-multiplexCh:
+			if other.err == nil {
+				if res.resp != nil {
+					discardBody(res.resp)
+				}
+				return other
+			}
+			errs = append(errs, other.err)
+			if other.resp != nil {
+				discardBody(other.resp)
+			}
+		case <-workersDoneCh:
+			if len(errs) > 1 {
+				res.err = errs
+			}
+			return res
+		}
+	}
+}
+
+// fitsDeadline reports whether another attempt taking about as long as attemptTook can be
+// made before the deadline of ctx, if any
+func fitsDeadline(ctx context.Context, attemptTook time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > attemptTook
+}
+
+// fatalStatus reports whether code is one of the FatalStatusCodes
+func (c *Client) fatalStatus(code int) bool {
+	for _, fatal := range c.FatalStatusCodes {
+		if code == fatal {
+			return true
+		}
+	}
+	return false
+}
+
+// cancelLosers cancels the context of every concurrent request but the one that produced
+// res, if res was accepted. Otherwise, the other requests are racing to a result that may
+// still be used, so they are left to finish. The context of the request that produced res
+// is cancelled once its response body is closed.
+func cancelLosers(res result, cancels []context.CancelFunc) result {
+	if res.accepted {
+		for n, cancel := range cancels {
+			if n != res.req {
+				cancel()
+			}
+		}
+	}
+	if cancels != nil {
+		if res.resp != nil && res.resp.StatusCode != http.StatusSwitchingProtocols {
+			res.resp.Body = &cancelBody{ReadCloser: res.resp.Body, cancel: cancels[res.req]}
+		} else if res.resp == nil {
+			cancels[res.req]()
+		}
 	}
 	return res
 }
 
-// Format the Error to human readable string
-func (c *Client) FormatError(e ErrEntry) string {
-	return fmt.Sprintf("%d %s [%s] %s request-%d retry-%d error: %s\n",
-		e.Time.Unix(), e.Method, e.Verb, e.URL, e.Request, e.Retry, e.Err)
+// doWithTimeout sends req with hc, cancelling it if its response headers take longer than
+// timeout. The context of a request that gets a response is cancelled once its body is closed.
+func (c *Client) doWithTimeout(hc *http.Client, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := hc.Do(req.WithContext(ctx))
+	if !timer.Stop() && req.Context().Err() == nil {
+		// the timeout fired, possibly just after the response came back
+		if resp != nil {
+			discardBody(resp)
+		}
+		cancel()
+		return nil, fmt.Errorf("%w of %s", ErrAdaptiveTimeout, timeout)
+	}
+	if resp == nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, err
 }
 
-// LogErrCount is a helper method used primarily for test validation
-func (c *Client) LogErrCount() int {
+// adaptiveTimeout returns the AdaptiveTimeout for the next attempt to host, or 0 if there
+// is none
+func (c *Client) adaptiveTimeout(host string) time.Duration {
+	if !c.AdaptiveTimeout {
+		return 0
+	}
 	c.Lock()
-	defer c.Unlock()
-	return len(c.ErrLog)
-}
+	w := c.latencies[host]
+	if w == nil || len(w.samples) < adaptiveTimeoutMinSamples {
+		c.Unlock()
+		return 0
+	}
+	samples := append([]time.Duration(nil), w.samples...)
+	c.Unlock()
 
-// EmbedHTTPClient allows you to extend an existing Pester client with an
-// underlying http.Client, such as https://godoc.org/golang.org/x/oauth2/google#DefaultClient
-func (c *Client) EmbedHTTPClient(hc *http.Client) {
-	c.hc = hc
+	percentile := c.AdaptiveTimeoutPercentile
+	if percentile <= 0 || percentile > 1 {
+		percentile = DefaultAdaptiveTimeoutPercentile
+	}
+	multiplier := c.AdaptiveTimeoutMultiplier
+	if multiplier <= 0 {
+		multiplier = DefaultAdaptiveTimeoutMultiplier
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	i := int(math.Ceil(percentile*float64(len(samples)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return time.Duration(float64(samples[i]) * multiplier)
 }
 
-func (c *Client) log(ctx context.Context, e ErrEntry) {
-	if c.KeepLog {
-		c.Lock()
-		defer c.Unlock()
-		c.ErrLog = append(c.ErrLog, e)
-	} else if c.ContextLogHook != nil {
-		// NOTE: There is a possibility that Log Printing hook slows it down.
-		// but the consumer can always do the Job in a go-routine.
-		c.ContextLogHook(ctx, e)
-	} else if c.LogHook != nil {
-		// NOTE: There is a possibility that Log Printing hook slows it down.
-		// but the consumer can always do the Job in a go-routine.
-		c.LogHook(e)
+// recordLatency adds the latency of an attempt to host for AdaptiveTimeout
+func (c *Client) recordLatency(host string, latency time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if c.latencies == nil {
+		c.latencies = map[string]*latencyWindow{}
+	}
+	w := c.latencies[host]
+	if w == nil {
+		w = &latencyWindow{}
+		c.latencies[host] = w
+	}
+	if len(w.samples) < adaptiveTimeoutWindow {
+		w.samples = append(w.samples, latency)
+		return
 	}
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % adaptiveTimeoutWindow
 }
 
-// Do provides the same functionality as http.Client.Do
-func (c *Client) Do(req *http.Request) (resp *http.Response, err error) {
-	return c.pester(params{method: methodDo, req: req, verb: req.Method, url: req.URL.String()})
+// hostClosing reports whether requests to host are sent with Close, see
+// HonorServerConnectionClose
+func (c *Client) hostClosing(host string) bool {
+	c.Lock()
+	defer c.Unlock()
+	until, ok := c.closingHosts[host]
+	if ok && !time.Now().Before(until) {
+		delete(c.closingHosts, host)
+		return false
+	}
+	return ok
 }
 
-// Get provides the same functionality as http.Client.Get
-func (c *Client) Get(url string) (resp *http.Response, err error) {
-	return c.pester(params{method: methodGet, url: url, verb: http.MethodGet})
+// closeHost sends the requests to host with Close for the next ServerConnectionCloseWindow
+func (c *Client) closeHost(host string) {
+	window := c.ServerConnectionCloseWindow
+	if window <= 0 {
+		window = DefaultServerConnectionCloseWindow
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.closingHosts == nil {
+		c.closingHosts = map[string]time.Time{}
+	}
+	c.closingHosts[host] = time.Now().Add(window)
 }
 
-// Head provides the same functionality as http.Client.Head
-func (c *Client) Head(url string) (resp *http.Response, err error) {
-	return c.pester(params{method: methodHead, url: url, verb: http.MethodHead})
+// cancelBody cancels the context of the request it belongs to when closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
 }
 
-// Post provides the same functionality as http.Client.Post
-func (c *Client) Post(url string, bodyType string, body io.Reader) (resp *http.Response, err error) {
-	return c.pester(params{method: methodPost, url: url, bodyType: bodyType, body: ioutil.NopCloser(body), verb: http.MethodPost})
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
 
-// PostForm provides the same functionality as http.Client.PostForm
-func (c *Client) PostForm(url string, data url.Values) (resp *http.Response, err error) {
-	return c.pester(params{method: methodPostForm, url: url, bodyType: contentTypeFormURLEncoded, body: ioutil.NopCloser(strings.NewReader(data.Encode())), verb: http.MethodPost})
+// finished reports whether finishCh has been closed
+func finished(finishCh chan struct{}) bool {
+	select {
+	case <-finishCh:
+		return true
+	default:
+		return false
+	}
 }
 
-// set RetryOnHTTP429 for clients,
-func (c *Client) SetRetryOnHTTP429(flag bool) {
-	c.RetryOnHTTP429 = flag
+// discardBody drains the body before closing it as to not prevent keepalive.
+// see https://gist.github.com/mholt/eba0f2cc96658be0f717
+func discardBody(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
 }
 
-////////////////////////////////////////
-// Provide self-constructing variants //
-////////////////////////////////////////
+// singleFlight makes the call for p unless the same call is already in flight, in which
+// case it waits for that call to finish. Either way, it returns a copy of the response.
+func (c *Client) singleFlight(p params) (*http.Response, int, error) {
+	key := p.verb + " " + p.url
 
-// Do provides the same functionality as http.Client.Do and creates its own constructor
-func Do(req *http.Request) (resp *http.Response, err error) {
-	c := New()
-	return c.Do(req)
+	c.Lock()
+	if c.flights == nil {
+		c.flights = map[string]*flight{}
+	}
+	f, ok := c.flights[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		c.flights[key] = f
+	}
+	c.Unlock()
+
+	if ok {
+		<-f.done
+	} else {
+		p.inFlight = true
+		f.resp, f.attempts, f.err = c.pesterAttempts(p)
+		if f.resp != nil {
+			var err error
+			if f.body, err = bufferBody(f.resp); err != nil && f.err == nil {
+				f.err = err
+			}
+		}
+
+		c.Lock()
+		delete(c.flights, key)
+		c.Unlock()
+		close(f.done)
+	}
+
+	if f.resp == nil {
+		return nil, f.attempts, f.err
+	}
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(f.body))
+	return &resp, f.attempts, f.err
 }
 
-// Get provides the same functionality as http.Client.Get and creates its own constructor
-func Get(url string) (resp *http.Response, err error) {
-	c := New()
-	return c.Get(url)
+// earnRetryBudget credits the retry budget for a new call
+func (c *Client) earnRetryBudget() {
+	c.Lock()
+	defer c.Unlock()
+	c.retryBudgetSpent -= c.RetryBudgetRatio
+	if c.retryBudgetSpent < 0 {
+		c.retryBudgetSpent = 0
+	}
 }
 
-// Head provides the same functionality as http.Client.Head and creates its own constructor
-func Head(url string) (resp *http.Response, err error) {
-	c := New()
-	return c.Head(url)
+// spendRetryBudget takes a retry from the retry budget, reporting false if none is left
+func (c *Client) spendRetryBudget() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.retryBudgetSpent+1 > retryBudgetBurst {
+		return false
+	}
+	c.retryBudgetSpent++
+	return true
 }
 
-// Post provides the same functionality as http.Client.Post and creates its own constructor
-func Post(url string, bodyType string, body io.Reader) (resp *http.Response, err error) {
-	c := New()
-	return c.Post(url, bodyType, body)
+// backoff returns how long to wait before retrying after the given attempt and its response
+func (c *Client) backoff(attempt int, resp *http.Response) time.Duration {
+	if c.RetryAfterFunc != nil && resp != nil {
+		if wait, ok := c.RetryAfterFunc(resp); ok {
+			return c.capBackoff(wait)
+		}
+	}
+	if c.TreatRedirectRetryAfterAsBackoff && isRetryAfterRedirect(resp) {
+		if wait, ok := parseRetryAfter(resp.Header.Get(headerKeyRetryAfter)); ok {
+			return c.capBackoff(wait)
+		}
+	}
+
+	wait := c.Backoff(attempt)
+	if c.LoadHeader != "" && resp != nil {
+		if load, err := strconv.ParseFloat(resp.Header.Get(c.LoadHeader), 64); err == nil && !math.IsNaN(load) {
+			if load < 0 {
+				load = 0
+			} else if load > 1 {
+				load = 1
+			}
+			wait = time.Duration(float64(wait) * (1 + load))
+		}
+	}
+	return c.capBackoff(wait)
 }
 
-// PostForm provides the same functionality as http.Client.PostForm and creates its own constructor
-func PostForm(url string, data url.Values) (resp *http.Response, err error) {
+// recordBody reads up to MaxRecordedBody bytes of the body from getBody for Recorder,
+// reporting whether there was more
+func (c *Client) recordBody(getBody func() (io.ReadCloser, error)) ([]byte, bool, error) {
+	limit := c.MaxRecordedBody
+	if limit <= 0 {
+		limit = DefaultMaxRecordedBody
+	}
+	body, err := getBody()
+	if err != nil {
+		return nil, false, err
+	}
+	defer body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(b)) > limit {
+		return b[:limit], true, nil
+	}
+	return b, false, nil
+}
+
+// clampBackoff raises a negative wait to 0, and any wait to MinInterval
+func (c *Client) clampBackoff(wait time.Duration) time.Duration {
+	if wait < 0 {
+		wait = 0
+	}
+	if wait < c.MinInterval {
+		wait = c.MinInterval
+	}
+	return wait
+}
+
+// capBackoff limits wait to the maximum set with SetMaxBackoff
+func (c *Client) capBackoff(wait time.Duration) time.Duration {
+	if c.maxBackoff > 0 && wait > c.maxBackoff {
+		return c.maxBackoff
+	}
+	return wait
+}
+
+// acquireCall waits for one of the MaxInFlightCalls slots, returning the function that
+// releases it
+func (c *Client) acquireCall(p params) (func(), error) {
+	c.Lock()
+	if c.callSlots == nil {
+		c.callSlots = make(chan struct{}, c.MaxInFlightCalls)
+	}
+	slots := c.callSlots
+	c.Unlock()
+
+	ctx := context.Background()
+	if p.req != nil {
+		ctx = p.req.Context()
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquireBodyBuffer waits until n bytes of MaxTotalBodyBuffer are available and takes them,
+// or takes them right away if no other body is buffered
+func (c *Client) acquireBodyBuffer(p params, n int64) error {
+	ctx := context.Background()
+	if p.req != nil {
+		ctx = p.req.Context()
+	}
+
+	for {
+		c.Lock()
+		if n == 0 || c.bodyBuffered == 0 || c.bodyBuffered+n <= c.MaxTotalBodyBuffer {
+			c.bodyBuffered += n
+			c.Unlock()
+			return nil
+		}
+		if c.bodyBufferFreed == nil {
+			c.bodyBufferFreed = make(chan struct{})
+		}
+		freed := c.bodyBufferFreed
+		c.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// releaseBodyBuffer gives n bytes back to MaxTotalBodyBuffer, waking up the calls waiting for it
+func (c *Client) releaseBodyBuffer(n int64) {
+	if n == 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.bodyBuffered -= n
+	if c.bodyBufferFreed != nil {
+		close(c.bodyBufferFreed)
+		c.bodyBufferFreed = nil
+	}
+}
+
+// spanError is the error an attempt's span is finished with
+func spanError(resp *http.Response, err error) error {
+	if err == nil && resp.StatusCode >= http.StatusBadRequest {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+	return err
+}
+
+// initialJitter sleeps for a random duration of up to InitialJitter, returning early with
+// the context's error if the request is cancelled in the meantime
+func (c *Client) initialJitter(p params) error {
+	ctx := context.Background()
+	if p.req != nil {
+		ctx = p.req.Context()
+	}
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(c.InitialJitter) + 1)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitRateLimit waits until the URL of the call is no longer rate limited, returning early
+// with the context's error if the request is cancelled in the meantime
+func (c *Client) waitRateLimit(p params) error {
+	c.Lock()
+	until, ok := c.rateLimited[p.url]
+	if ok && !time.Now().Before(until) {
+		delete(c.rateLimited, p.url)
+	}
+	c.Unlock()
+	wait := time.Until(until)
+	if !ok || wait <= 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	if p.req != nil {
+		ctx = p.req.Context()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rememberRateLimit makes the next calls to url wait, after a 429 response to it
+func (c *Client) rememberRateLimit(url string, resp *http.Response) {
+	wait, ok := parseRetryAfter(resp.Header.Get(headerKeyRetryAfter))
+	if !ok {
+		wait = c.backoff(1, resp)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.rateLimited == nil {
+		c.rateLimited = map[string]time.Time{}
+	}
+	c.rateLimited[url] = time.Now().Add(c.capBackoff(wait))
+}
+
+// retryable reports whether the outcome of an attempt should be retried.
+// Only errors, RetryableStatusCodes, 429 (when RetryOnHTTP429 is set), and redirects with
+// a Retry-After header (when TreatRedirectRetryAfterAsBackoff is set) are retried.
+// Insecure redirects are never retried, hosts that do not exist are only retried when
+// RetryOnDNSError is set, and errors only when they match RetryErrorPattern, if set.
+// With RetryOnlyIfNothingWritten, errors of non-idempotent methods are only retried when
+// nothing was written. Errors returned by CheckRedirect are treated like any other error.
+func (c *Client) retryable(method string, resp *http.Response, err error) bool {
+	if err != nil {
+		if errors.Is(err, ErrInsecureRedirect) || errors.Is(err, ErrTooManyRedirects) {
+			return false
+		}
+		if c.RetryOnlyIfNothingWritten && !idempotent(method) && !nothingWritten(err) {
+			return false
+		}
+		var dnsErr *net.DNSError
+		if !c.RetryOnDNSError && errors.As(err, &dnsErr) && dnsErr.IsNotFound && !dnsErr.IsTemporary {
+			return false
+		}
+		if c.RetryErrorPattern != nil {
+			return c.RetryErrorPattern.MatchString(err.Error())
+		}
+		return true
+	}
+	if c.TreatRedirectRetryAfterAsBackoff && isRetryAfterRedirect(resp) {
+		return true
+	}
+	if resp.StatusCode == http.StatusTooManyRequests && c.RetryOnHTTP429 {
+		return true
+	}
+	if c.retryableGRPCStatus(resp) {
+		return true
+	}
+	codes := c.RetryableStatusCodes
+	if codes == nil {
+		codes = DefaultRetryableStatusCodes
+	}
+	return codes[resp.StatusCode]
+}
+
+// grpcStatusInTrailer reports whether the gRPC status of resp is only sent in a trailer,
+// so that the body must be read to learn it
+func (c *Client) grpcStatusInTrailer(resp *http.Response) bool {
+	if c.GRPCStatusHeader == "" || resp.Header.Get(c.GRPCStatusHeader) != "" {
+		return false
+	}
+	_, ok := resp.Trailer[http.CanonicalHeaderKey(c.GRPCStatusHeader)]
+	return ok
+}
+
+// retryableGRPCStatus reports whether the gRPC status code of resp, from its header or
+// else its trailer, is one of RetryableGRPCCodes
+func (c *Client) retryableGRPCStatus(resp *http.Response) bool {
+	if c.GRPCStatusHeader == "" {
+		return false
+	}
+	status := resp.Header.Get(c.GRPCStatusHeader)
+	if status == "" {
+		status = resp.Trailer.Get(c.GRPCStatusHeader)
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(status))
+	if err != nil {
+		return false
+	}
+	for _, retryable := range c.RetryableGRPCCodes {
+		if code == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+// idempotent reports whether the given HTTP method is idempotent as defined by RFC 7231
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// nothingWritten reports whether err shows that the request failed before any of it
+// could be written to the server, which is the case for DNS, dial, and proxy connect errors
+func nothingWritten(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
+
+// httpsOnlyRedirect wraps a CheckRedirect function, which may be nil, to also reject
+// redirects from https to http
+func httpsOnlyRedirect(next func(req *http.Request, via []*http.Request) error) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if next != nil {
+			if err := next(req, via); err != nil {
+				return err
+			}
+		} else if len(via) >= 10 {
+			// the http.Client default when there is no CheckRedirect
+			return errors.New("stopped after 10 redirects")
+		}
+		if len(via) > 0 && via[len(via)-1].URL.Scheme == "https" && req.URL.Scheme == "http" {
+			return ErrInsecureRedirect
+		}
+		return nil
+	}
+}
+
+// maxRedirects wraps a CheckRedirect function, which may be nil, to stop after max redirects
+func maxRedirects(max int, next func(req *http.Request, via []*http.Request) error) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return fmt.Errorf("%w: stopped after %d redirects", ErrTooManyRedirects, max)
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		return nil
+	}
+}
+
+// retryAfterRedirect wraps a CheckRedirect function, which may be nil, to not follow
+// redirects that come with a Retry-After header, returning the redirect response instead
+func retryAfterRedirect(next func(req *http.Request, via []*http.Request) error) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if isRetryAfterRedirect(req.Response) {
+			return http.ErrUseLastResponse
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= 10 {
+			// the http.Client default when there is no CheckRedirect
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+}
+
+// isRetryAfterRedirect reports whether resp is a redirect with a Retry-After header
+func isRetryAfterRedirect(resp *http.Response) bool {
+	return resp != nil && resp.StatusCode >= 300 && resp.StatusCode < 400 && resp.Header.Get(headerKeyRetryAfter) != ""
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of
+// seconds or an HTTP date
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	wait := time.Until(t)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// attemptContextKey is the context key for the number of the attempt a request is sent for
+type attemptContextKey struct{}
+
+// attemptContext returns the context that a single attempt is sent with
+func (c *Client) attemptContext(ctx context.Context, attempt int) context.Context {
+	ctx = context.WithValue(ctx, attemptContextKey{}, attempt)
+	if c.On1xx == nil && c.OnConnReuse == nil {
+		return ctx
+	}
+
+	trace := &httptrace.ClientTrace{}
+	if c.On1xx != nil {
+		trace.Got1xxResponse = func(code int, header textproto.MIMEHeader) error {
+			c.On1xx(code, http.Header(header))
+			return nil
+		}
+	}
+	if c.OnConnReuse != nil {
+		trace.GotConn = func(info httptrace.GotConnInfo) {
+			c.OnConnReuse(attempt, info.Reused)
+		}
+	}
+	return httptrace.WithClientTrace(ctx, trace)
+}
+
+// proxyTransport returns a copy of base that picks its proxy with NextProxy for every
+// attempt. The copy is kept so that its connections can be reused across calls.
+func (c *Client) proxyTransport(base http.RoundTripper) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t, ok := base.(*http.Transport)
+	if !ok {
+		return nil, ErrProxyRotationUnsupported
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.proxied == nil || c.proxyBase != t {
+		c.proxyBase = t
+		c.proxied = t.Clone()
+		c.proxied.Proxy = func(req *http.Request) (*url.URL, error) {
+			attempt, _ := req.Context().Value(attemptContextKey{}).(int)
+			return c.NextProxy(attempt)
+		}
+	}
+	return c.proxied, nil
+}
+
+// resolveBaseURL resolves relative call URLs against BaseURL as described in RFC 3986.
+// Absolute URLs are left untouched.
+func (c *Client) resolveBaseURL(p *params) error {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return err
+	}
+
+	if p.req != nil {
+		if p.req.URL.IsAbs() {
+			return nil
+		}
+		p.ownRequest()
+		p.req.URL = base.ResolveReference(p.req.URL)
+		p.url = p.req.URL.String()
+		return nil
+	}
+
+	ref, err := url.Parse(p.url)
+	if err != nil {
+		return err
+	}
+	p.url = base.ResolveReference(ref).String()
+	return nil
+}
+
+// overridesMethod reports whether MethodOverride sends requests using method as a POST
+func overridesMethod(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodPost:
+		return false
+	}
+	return true
+}
+
+// newRequestID generates a random ID for a call
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// unreplayableError wraps the error of an attempt that cannot be retried because of its body
+func unreplayableError(err error) error {
+	if err == nil {
+		return ErrUnreplayableBody
+	}
+	return fmt.Errorf("%w: %v", ErrUnreplayableBody, err)
+}
+
+// mirror sends req to the MirrorTo base URL once, in the background, without retries.
+// The outcome is only reported to OnMirrorResponse and never affects the primary request.
+func (c *Client) mirror(httpClient http.Client, req *http.Request, done func()) {
+	report := func(resp *http.Response, err error) {
+		if c.OnMirrorResponse != nil {
+			c.OnMirrorResponse(resp, err)
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	base, err := url.Parse(c.MirrorTo)
+	if err != nil {
+		report(nil, err)
+		done()
+		return
+	}
+	req.URL.Scheme = base.Scheme
+	req.URL.Host = base.Host
+	req.URL.Path = strings.TrimSuffix(base.Path, "/") + req.URL.Path
+	req.URL.RawPath = ""
+	req.Host = ""
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer done()
+		if c.Signer != nil {
+			if err := c.Signer.Sign(req); err != nil {
+				report(nil, err)
+				return
+			}
+		}
+		report(httpClient.Do(req))
+	}()
+}
+
+// LogString provides a string representation of the errors the client has seen
+func (c *Client) LogString() string {
+	c.Lock()
+	defer c.Unlock()
+	var res string
+	for _, e := range c.ErrLog {
+		res += c.FormatError(e)
+	}
+	return res
+}
+
+// Format the Error to human readable string
+func (c *Client) FormatError(e ErrEntry) string {
+	return fmt.Sprintf("%d %s [%s] %s request-%d retry-%d error: %s\n",
+		e.Time.Unix(), e.Method, e.Verb, e.URL, e.Request, e.Retry, e.Err)
+}
+
+// LogErrCount is a helper method used primarily for test validation
+func (c *Client) LogErrCount() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.ErrLog)
+}
+
+// httpClientContextKey is the context key for the http.Client set with WithHTTPClient
+type httpClientContextKey struct{}
+
+// WithHTTPClient returns a copy of ctx that makes calls whose request carries it use hc
+// instead of the client's own http.Client, whether it was set with NewExtendedClient,
+// EmbedHTTPClient, or built from Transport, CheckRedirect, Jar, and Timeout, while still
+// applying every retry option of the client. Options changing the http.Client, such as
+// HTTPSOnly or NextProxy, apply to hc as they would to the client's own.
+func WithHTTPClient(ctx context.Context, hc *http.Client) context.Context {
+	return context.WithValue(ctx, httpClientContextKey{}, hc)
+}
+
+// EmbedHTTPClient allows you to extend an existing Pester client with an
+// underlying http.Client, such as https://godoc.org/golang.org/x/oauth2/google#DefaultClient
+func (c *Client) EmbedHTTPClient(hc *http.Client) {
+	c.hc = hc
+}
+
+// loggedHeaders returns a copy of the headers that is safe to keep in the log
+func (c *Client) loggedHeaders(h http.Header) http.Header {
+	if !c.LogRequestHeaders {
+		return nil
+	}
+	return c.redactHeaders(h)
+}
+
+// redactHeaders returns a copy of the headers with Authorization and RedactHeaders redacted
+func (c *Client) redactHeaders(h http.Header) http.Header {
+	logged := h.Clone()
+	if logged == nil {
+		logged = http.Header{}
+	}
+	for _, key := range append([]string{"Authorization"}, c.RedactHeaders...) {
+		if _, ok := logged[http.CanonicalHeaderKey(key)]; ok {
+			logged.Set(key, redacted)
+		}
+	}
+	return logged
+}
+
+// metadata returns the metadata for the ErrEntry of an attempt sent with ctx
+func (c *Client) metadata(ctx context.Context) map[string]string {
+	if c.MetadataFromContext == nil {
+		return nil
+	}
+	return c.MetadataFromContext(ctx)
+}
+
+// redactURL applies URLRedactor, if set, to u
+func (c *Client) redactURL(u string) string {
+	if c.URLRedactor == nil {
+		return u
+	}
+	return c.URLRedactor(u)
+}
+
+// redactURLError returns err with the URL redacted if it is a *url.Error. The error
+// returned to the caller is left untouched.
+func (c *Client) redactURLError(err error) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok || c.URLRedactor == nil {
+		return err
+	}
+	redactedErr := *urlErr
+	redactedErr.URL = c.URLRedactor(urlErr.URL)
+	return &redactedErr
+}
+
+func (c *Client) log(ctx context.Context, e ErrEntry) {
+	if c.KeepLog {
+		c.Lock()
+		c.ErrLog = append(c.ErrLog, e)
+		c.Unlock()
+	}
+
+	// NOTE: There is a possibility that Log Printing hooks slow it down.
+	// but the consumer can always do the Job in a go-routine.
+	if c.ContextLogHook != nil {
+		c.ContextLogHook(ctx, e)
+	}
+	if c.LogHook != nil {
+		c.LogHook(e)
+	}
+}
+
+// Do provides the same functionality as http.Client.Do
+func (c *Client) Do(req *http.Request) (resp *http.Response, err error) {
+	return c.pester(params{method: methodDo, req: req, verb: req.Method, url: req.URL.String()})
+}
+
+// DoAttempts provides the same functionality as http.Client.Do and also returns the number
+// of attempts it took. Unlike SuccessRetryNum, it is safe to use on a shared client.
+// With Concurrency, it is the number of attempts of the request whose result is returned.
+func (c *Client) DoAttempts(req *http.Request) (*http.Response, int, error) {
+	return c.pesterAttempts(params{method: methodDo, req: req, verb: req.Method, url: req.URL.String()})
+}
+
+// RoundTripper returns an http.RoundTripper that sends requests with the retries, backoff,
+// and concurrency of c, through the Transport of the http.Client that c embeds. This allows
+// using pester with an http.Client or any library that accepts a transport. Redirects,
+// cookies, and the timeout are left to the http.Client using the RoundTripper, and request
+// bodies are replayed on every attempt like for Do.
+func (c *Client) RoundTripper() http.RoundTripper {
+	return retryTransport{c: c}
+}
+
+// retryTransport is the http.RoundTripper returned by RoundTripper
+type retryTransport struct {
+	c *Client
+}
+
+// RoundTrip implements http.RoundTripper
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	resp, err := t.c.pester(params{method: methodDo, req: req, verb: req.Method, url: req.URL.String(), roundTrip: true})
+	if err == nil {
+		return resp, nil
+	}
+	// a RoundTripper returns either a response or an error
+	if resp != nil {
+		discardBody(resp)
+	}
+	// the http.Client using the RoundTripper adds the method and URL to errors itself
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	return nil, err
+}
+
+// RequestBuilder builds a request to send with Do, see NewRequest. The first error met
+// while building is returned by Do.
+type RequestBuilder struct {
+	c      *Client
+	method string
+	url    string
+	header http.Header
+	query  url.Values
+	body   io.Reader
+	err    error
+}
+
+// NewRequest starts building a request with the given method and URL, such as
+//
+//	resp, err := c.NewRequest(http.MethodPost, "https://example.com/items").
+//		Header("Authorization", token).
+//		JSON(item).
+//		Do(ctx)
+func (c *Client) NewRequest(method, rawURL string) *RequestBuilder {
+	return &RequestBuilder{c: c, method: method, url: rawURL, header: http.Header{}, query: url.Values{}}
+}
+
+// Header adds a header value to the request
+func (b *RequestBuilder) Header(key, value string) *RequestBuilder {
+	b.header.Add(key, value)
+	return b
+}
+
+// Query adds a query parameter to the request URL, keeping those already in the URL
+func (b *RequestBuilder) Query(key, value string) *RequestBuilder {
+	b.query.Add(key, value)
+	return b
+}
+
+// Body sets the request body
+func (b *RequestBuilder) Body(r io.Reader) *RequestBuilder {
+	b.body = r
+	return b
+}
+
+// JSON sets the request body to v encoded as JSON, and the Content-Type header to
+// application/json unless it is already set
+func (b *RequestBuilder) JSON(v interface{}) *RequestBuilder {
+	data, err := json.Marshal(v)
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return b
+	}
+	b.body = bytes.NewReader(data)
+	if b.header.Get(headerKeyContentType) == "" {
+		b.header.Set(headerKeyContentType, contentTypeJSON)
+	}
+	return b
+}
+
+// Do sends the request with ctx using the Do method of the client
+func (b *RequestBuilder) Do(ctx context.Context) (*http.Response, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	req, err := http.NewRequest(b.method, b.url, b.body)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.query) > 0 {
+		q := req.URL.Query()
+		for k, vs := range b.query {
+			q[k] = append(q[k], vs...)
+		}
+		req.URL.RawQuery = q.Encode()
+	}
+	for k, vs := range b.header {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	return b.c.Do(req.WithContext(ctx))
+}
+
+// Get provides the same functionality as http.Client.Get
+func (c *Client) Get(url string) (resp *http.Response, err error) {
+	return c.pester(params{method: methodGet, url: url, verb: http.MethodGet})
+}
+
+// GetBytes provides the same functionality as http.Client.Get but returns the response body
+// and status code, taking care of reading and closing the body. As the body is read as part
+// of each attempt, an error reading it is retried like any other error.
+func (c *Client) GetBytes(url string) ([]byte, int, error) {
+	resp, err := c.pester(params{method: methodGet, url: url, verb: http.MethodGet, bufferResponse: true})
+	if resp == nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	b, readErr := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		err = readErr
+	}
+	return b, resp.StatusCode, err
+}
+
+// GetQuorum sends n GET requests to url at the same time and returns every response and
+// error once they have all settled. Each request is retried independently. The response
+// and error at index i belong to the same request. All non-nil response bodies are left
+// open and must be closed by the caller. Both slices are empty when n is not positive.
+func (c *Client) GetQuorum(url string, n int) ([]*http.Response, []error) {
+	if n <= 0 {
+		return []*http.Response{}, []error{}
+	}
+
+	resps := make([]*http.Response, n)
+	errs := make([]error, n)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resps[i], errs[i] = c.Get(url)
+		}(i)
+	}
+	wg.Wait()
+
+	return resps, errs
+}
+
+// Poll repeatedly calls Get on url, for long polling, passing every successful response
+// to handler until handler returns an error or ctx is done, and returns that error. Calls
+// that fail, with an error or a retryable status once their own retries are used up, are
+// not passed to handler. Instead, Poll waits for Backoff with the number of consecutive
+// failed calls, which resets to 0 after a successful one, and at least MinInterval, before
+// calling again. The response body is closed once handler returns.
+func (c *Client) Poll(ctx context.Context, url string, handler func(resp *http.Response) error) error {
+	if c.Backoff == nil {
+		return ErrMissingBackoff
+	}
+
+	failures := 0
+	for {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.Do(req.WithContext(ctx))
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return ctx.Err()
+		}
+
+		if err == nil && !c.retryable(http.MethodGet, resp, nil) {
+			failures = 0
+			err = handler(resp)
+			resp.Body.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		failures++
+		wait := c.clampBackoff(c.backoff(failures, resp))
+		if resp != nil {
+			discardBody(resp)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Retry calls fn, with the number of the attempt starting at 1, until it returns nil, ctx
+// is done, or MaxRetries attempts have been made, waiting Backoff, MinInterval, and the
+// maximum backoff between attempts like requests do, so that operations other than HTTP
+// calls can be retried the same way. When RetryableError is set, only errors it accepts
+// are retried. Retry returns the last error of fn, or ctx.Err() if ctx was done first.
+func (c *Client) Retry(ctx context.Context, fn func(attempt int) error) error {
+	if c.Backoff == nil {
+		return ErrMissingBackoff
+	}
+
+	attemptLimit := c.MaxRetries
+	if attemptLimit <= 0 {
+		attemptLimit = 1
+	}
+	for i := 1; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := fn(i)
+		if err == nil {
+			return nil
+		}
+		c.log(ctx, ErrEntry{
+			Time:    time.Now(),
+			Retry:   i + 1,
+			Attempt: i,
+			Err:     err,
+
+			Metadata: c.metadata(ctx),
+		})
+		if i >= attemptLimit || c.RetryableError != nil && !c.RetryableError(err) {
+			return err
+		}
+
+		wait := c.clampBackoff(c.backoff(i, nil))
+		if c.OnBackoffStart != nil {
+			c.OnBackoffStart(i, wait)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			if c.OnBackoffEnd != nil {
+				c.OnBackoffEnd(i, false)
+			}
+		case <-ctx.Done():
+			timer.Stop()
+			if c.OnBackoffEnd != nil {
+				c.OnBackoffEnd(i, true)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// Event is a server-sent event received by StreamSSE
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry is the reconnection time the server asked for with the event, if any
+	Retry time.Duration
+}
+
+// StreamSSE connects to the server-sent events stream at url and passes every event to
+// handler until ctx is done, and returns ctx.Err(). When the stream cannot be opened or
+// ends, StreamSSE reconnects after the reconnection time sent by the server, if any, or
+// after Backoff with the number of consecutive failed connections otherwise, sending the
+// ID of the last event in a Last-Event-ID header. A 204 No Content response stops
+// StreamSSE with ErrStreamEnded, and other responses that are not retried, such as a 401,
+// stop it with a *StatusError, as do errors that are not retried. Each connection is made
+// like Do, with retries, so options that read response bodies into memory, such as
+// RetryOnEmptyBody, must not be set, and a Timeout cuts every stream short.
+func (c *Client) StreamSSE(ctx context.Context, url string, handler func(e Event)) error {
+	if c.Backoff == nil {
+		return ErrMissingBackoff
+	}
+
+	var (
+		lastEventID string
+		retry       time.Duration
+		failures    int
+	)
+	for {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(headerKeyAccept, contentTypeEventStream)
+		req.Header.Set("Cache-Control", "no-cache")
+		if lastEventID != "" {
+			req.Header.Set(headerKeyLastEventID, lastEventID)
+		}
+
+		resp, err := c.Do(req.WithContext(ctx))
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return ctx.Err()
+		}
+		if err == nil && resp.StatusCode == http.StatusOK {
+			failures = 0
+			readEvents(resp.Body, func(e Event) {
+				if e.Retry > 0 {
+					retry = e.Retry
+				}
+				if e.ID != "" {
+					lastEventID = e.ID
+				}
+				if e.Data != "" {
+					handler(e)
+				}
+			})
+			resp.Body.Close()
+		} else if err == nil && resp.StatusCode == http.StatusNoContent {
+			discardBody(resp)
+			return ErrStreamEnded
+		} else if !c.retryable(http.MethodGet, resp, err) {
+			if err != nil {
+				return err
+			}
+			discardBody(resp)
+			return &StatusError{StatusCode: resp.StatusCode}
+		} else if resp != nil {
+			discardBody(resp)
+		}
+
+		failures++
+		wait := retry
+		if wait == 0 {
+			wait = c.backoff(failures, resp)
+		}
+		timer := time.NewTimer(c.clampBackoff(wait))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// readEvents parses the server-sent events read from r, passing every event, including
+// those only setting the ID or reconnection time, to dispatch until r is done
+func readEvents(r io.Reader, dispatch func(e Event)) {
+	br := bufio.NewReader(r)
+	var (
+		e    Event
+		data []string
+		seen bool
+	)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && line == "" {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if seen {
+				e.Data = strings.Join(data, "\n")
+				dispatch(e)
+			}
+			e, data, seen = Event{ID: e.ID}, nil, false
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// a comment, such as a keep-alive
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				e.ID = value
+				seen = true
+			}
+		case "event":
+			e.Event = value
+			seen = true
+		case "data":
+			data = append(data, value)
+			seen = true
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				e.Retry = time.Duration(ms) * time.Millisecond
+				seen = true
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Head provides the same functionality as http.Client.Head
+func (c *Client) Head(url string) (resp *http.Response, err error) {
+	return c.pester(params{method: methodHead, url: url, verb: http.MethodHead})
+}
+
+// Post provides the same functionality as http.Client.Post
+func (c *Client) Post(url string, bodyType string, body io.Reader) (resp *http.Response, err error) {
+	rc := nopCloser(body)
+	if closer, ok := body.(io.ReadCloser); ok && c.CloseCallerBody {
+		rc = closer
+	}
+	return c.pester(params{method: methodPost, url: url, bodyType: bodyType, body: rc, verb: http.MethodPost})
+}
+
+// PostForm provides the same functionality as http.Client.PostForm
+func (c *Client) PostForm(url string, data url.Values) (resp *http.Response, err error) {
+	return c.pester(params{method: methodPostForm, url: url, bodyType: contentTypeFormURLEncoded, body: nopCloser(strings.NewReader(data.Encode())), verb: http.MethodPost})
+}
+
+// PostFormWith is like PostForm, but the body is data encoded by encoder, for servers
+// requiring the parameters in a given order or encoded in a non-standard way
+func (c *Client) PostFormWith(url string, data url.Values, encoder func(data url.Values) string) (resp *http.Response, err error) {
+	return c.pester(params{method: methodPostForm, url: url, bodyType: contentTypeFormURLEncoded, body: nopCloser(strings.NewReader(encoder(data))), verb: http.MethodPost})
+}
+
+// RegisterDecoder adds a decoder, such as a brotli or zstd reader, for response bodies with
+// the given Content-Encoding, which the transport does not decode, unlike gzip. Response
+// bodies that pester reads into memory, for GetBytes, ValidatePostResponseBody, and
+// RetryOnEmptyBody, are then returned decoded, and an error decoding them is retried like
+// an error reading them.
+func (c *Client) RegisterDecoder(encoding string, fn func(io.Reader) io.Reader) {
+	c.Lock()
+	defer c.Unlock()
+	if c.decoders == nil {
+		c.decoders = map[string]func(io.Reader) io.Reader{}
+	}
+	c.decoders[strings.ToLower(encoding)] = fn
+}
+
+// decodeBody decodes the buffered body b of resp with the decoder registered for its
+// Content-Encoding, if any, replacing the body with the decoded one like the transport
+// does for gzip
+func (c *Client) decodeBody(resp *http.Response, b []byte) ([]byte, error) {
+	encoding := strings.ToLower(resp.Header.Get(headerKeyContentEncoding))
+	if encoding == "" {
+		return b, nil
+	}
+	c.Lock()
+	decode := c.decoders[encoding]
+	c.Unlock()
+	if decode == nil {
+		return b, nil
+	}
+
+	decoded, err := ioutil.ReadAll(decode(bytes.NewReader(b)))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(decoded))
+	resp.Header.Del(headerKeyContentEncoding)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return decoded, nil
+}
+
+// SetMaxBackoff caps the wait between attempts to d, whatever the Backoff strategy.
+// A d of 0 removes the cap.
+func (c *Client) SetMaxBackoff(d time.Duration) {
+	c.maxBackoff = d
+}
+
+// set RetryOnHTTP429 for clients,
+func (c *Client) SetRetryOnHTTP429(flag bool) {
+	c.RetryOnHTTP429 = flag
+}
+
+////////////////////////////////////////
+// Provide self-constructing variants //
+////////////////////////////////////////
+
+// Do provides the same functionality as http.Client.Do and creates its own constructor
+func Do(req *http.Request) (resp *http.Response, err error) {
+	c := New()
+	return c.Do(req)
+}
+
+// Get provides the same functionality as http.Client.Get and creates its own constructor
+func Get(url string) (resp *http.Response, err error) {
+	c := New()
+	return c.Get(url)
+}
+
+// Head provides the same functionality as http.Client.Head and creates its own constructor
+func Head(url string) (resp *http.Response, err error) {
+	c := New()
+	return c.Head(url)
+}
+
+// Post provides the same functionality as http.Client.Post and creates its own constructor
+func Post(url string, bodyType string, body io.Reader) (resp *http.Response, err error) {
+	c := New()
+	return c.Post(url, bodyType, body)
+}
+
+// PostForm provides the same functionality as http.Client.PostForm and creates its own constructor
+func PostForm(url string, data url.Values) (resp *http.Response, err error) {
 	c := New()
 	return c.PostForm(url, data)
 }
+
+// PostFormWith provides the same functionality as Client.PostFormWith and creates its own constructor
+func PostFormWith(url string, data url.Values, encoder func(data url.Values) string) (resp *http.Response, err error) {
+	c := New()
+	return c.PostFormWith(url, data, encoder)
+}
@@ -1,21 +1,30 @@
 package pester
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
+	"net/url"
 	"os"
+	"regexp"
 	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -455,6 +464,43 @@ func TestCustomContextLogHook(t *testing.T) {
 	}
 }
 
+func TestKeepLogWithLogHooks(t *testing.T) {
+	t.Parallel()
+
+	var hookLines, contextHookLines int32
+
+	c := New()
+	c.KeepLog = true
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration {
+		return 10 * time.Microsecond
+	}
+	c.LogHook = func(e ErrEntry) {
+		atomic.AddInt32(&hookLines, 1)
+	}
+	c.ContextLogHook = func(ctx context.Context, e ErrEntry) {
+		atomic.AddInt32(&contextHookLines, 1)
+	}
+
+	nonExistantURL := "http://localhost:9000/foo"
+
+	_, err := c.Get(nonExistantURL)
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+	c.Wait()
+
+	if got := c.LogErrCount(); got != 3 {
+		t.Errorf("Expected 3 entries in ErrLog. Got %d", got)
+	}
+	if got := atomic.LoadInt32(&hookLines); got != 3 {
+		t.Errorf("Expected 3 lines to be emitted to LogHook. Got %d", got)
+	}
+	if got := atomic.LoadInt32(&contextHookLines); got != 3 {
+		t.Errorf("Expected 3 lines to be emitted to ContextLogHook. Got %d", got)
+	}
+}
+
 func TestDefaultLogHook(t *testing.T) {
 	t.Parallel()
 
@@ -702,6 +748,65 @@ func TestConcurrentRequestsNotRacyAndDontLeak_SuccessfulRequest(t *testing.T) {
 	}
 }
 
+func TestWaitClosesLateBodiesAndDoesNotLeak(t *testing.T) {
+	goroStart := runtime.NumGoroutine()
+
+	var open int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			// only the first of the concurrent requests wins, the others come back late
+			atomic.AddInt32(&open, 1)
+			return &http.Response{StatusCode: http.StatusOK, Body: countedBody{strings.NewReader("body"), &open}, Request: r}, nil
+		}),
+	})
+	c.Concurrency = 5
+	c.MaxRetries = 1
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.Get("http://example.com")
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	c.Wait()
+
+	if got := atomic.LoadInt32(&open); got != 0 {
+		t.Errorf("got %d open response bodies after Wait, want 0", got)
+	}
+	// goroutines that are done may still be on their way out
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroStart && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if goroEnd := runtime.NumGoroutine(); goroEnd > goroStart {
+		t.Errorf("got %d running goroutines, want %d", goroEnd, goroStart)
+		pprof.Lookup("goroutine").WriteTo(os.Stdout, 1)
+	}
+}
+
+// countedBody decrements open when closed
+type countedBody struct {
+	io.Reader
+	open *int32
+}
+
+// Read is slow so that the late bodies take a while to be drained
+func (b countedBody) Read(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	return b.Reader.Read(p)
+}
+
+func (b countedBody) Close() error {
+	atomic.AddInt32(b.open, -1)
+	return nil
+}
+
 func TestRetriesNotAttemptedIfContextIsCancelled(t *testing.T) {
 	t.Parallel()
 
@@ -909,6 +1014,4958 @@ func TestRetriesWithBodies_POST(t *testing.T) {
 	}
 }
 
+func TestConcurrencySafe(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	calls := 0
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			// give the other concurrent requests a chance to go out before failing
+			<-time.After(50 * time.Millisecond)
+			return nil, fmt.Errorf("always fail")
+		}),
+	})
+	c.Concurrency = 3
+	c.MaxRetries = 1
+
+	tests := []struct {
+		name  string
+		safe  func(string) bool
+		verb  string
+		calls int
+	}{
+		{name: "default GET", verb: http.MethodGet, calls: 3},
+		{name: "default HEAD", verb: http.MethodHead, calls: 3},
+		{name: "default DELETE", verb: http.MethodDelete, calls: 1},
+		{name: "custom DELETE", verb: http.MethodDelete, calls: 3, safe: func(method string) bool { return method == http.MethodDelete }},
+		{name: "custom GET", verb: http.MethodGet, calls: 1, safe: func(method string) bool { return method == http.MethodDelete }},
+	}
+
+	for _, tt := range tests {
+		mu.Lock()
+		calls = 0
+		mu.Unlock()
+		c.ConcurrencySafe = tt.safe
+
+		req, err := http.NewRequest(tt.verb, "http://localhost", nil)
+		if err != nil {
+			t.Fatalf("unable to create request %v", err)
+		}
+		if _, err := c.Do(req); err == nil {
+			t.Fatalf("%s: expected to get an error", tt.name)
+		}
+		c.Wait()
+
+		mu.Lock()
+		if got, want := calls, tt.calls; got != want {
+			t.Errorf("%s: got %d calls, want %d", tt.name, got, want)
+		}
+		mu.Unlock()
+	}
+}
+
+type countingSigner struct {
+	sync.Mutex
+	calls int
+	err   error
+}
+
+func (s *countingSigner) Sign(r *http.Request) error {
+	s.Lock()
+	defer s.Unlock()
+	s.calls++
+	r.Header.Set("X-Signature", strconv.Itoa(s.calls))
+	return s.err
+}
+
+func TestSignerCalledEachAttempt(t *testing.T) {
+	t.Parallel()
+
+	signatures := make(chan string, 4)
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			signatures <- r.Header.Get("X-Signature")
+			return nil, fmt.Errorf("always fail")
+		}),
+	})
+	c.MaxRetries = cap(signatures)
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	signer := &countingSigner{}
+	c.Signer = signer
+
+	if _, err := c.Post("http://localhost", "text/plain", strings.NewReader("body")); err == nil {
+		t.Fatal("expected to get an error")
+	}
+	c.Wait()
+	close(signatures)
+
+	if got, want := signer.calls, c.MaxRetries; got != want {
+		t.Errorf("got %d sign calls, want %d", got, want)
+	}
+	var attempt int
+	for sig := range signatures {
+		attempt++
+		if got, want := sig, strconv.Itoa(attempt); got != want {
+			t.Errorf("got signature %q on attempt %d, want %q", got, attempt, want)
+		}
+	}
+}
+
+func TestSignerError(t *testing.T) {
+	t.Parallel()
+
+	signErr := errors.New("unable to sign")
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			t.Error("request should not be sent when signing fails")
+			return nil, fmt.Errorf("always fail")
+		}),
+	})
+	signer := &countingSigner{err: signErr}
+	c.Signer = signer
+
+	if _, err := c.Get("http://localhost"); err != signErr {
+		t.Fatalf("got error %v, want %v", err, signErr)
+	}
+	if got, want := signer.calls, 1; got != want {
+		t.Errorf("got %d sign calls, want %d", got, want)
+	}
+}
+
+func TestLogRequestHeaders(t *testing.T) {
+	t.Parallel()
+
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return nil, fmt.Errorf("always fail")
+		}),
+	})
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.KeepLog = true
+	c.LogRequestHeaders = true
+	c.RedactHeaders = []string{"x-api-key"}
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Api-Key", "secret")
+	req.Header.Set("Accept", "text/plain")
+
+	if _, err := c.Do(req); err == nil {
+		t.Fatal("expected to get an error")
+	}
+	c.Wait()
+
+	if got, want := c.LogErrCount(), c.MaxRetries; got != want {
+		t.Fatalf("got %d errors, want %d", got, want)
+	}
+	for _, e := range c.ErrLog {
+		for key, want := range map[string]string{
+			"Authorization": redacted,
+			"X-Api-Key":     redacted,
+			"Accept":        "text/plain",
+		} {
+			if got := e.RequestHeaders.Get(key); got != want {
+				t.Errorf("got %s header %q, want %q", key, got, want)
+			}
+		}
+	}
+	if got, want := req.Header.Get("Authorization"), "Bearer secret"; got != want {
+		t.Errorf("request header was modified, got %q, want %q", got, want)
+	}
+}
+
+func TestReturnLastResponseOnCancel(t *testing.T) {
+	t.Parallel()
+
+	port, closeFn, err := middlewareServer(always500RequestMiddleware())
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	for _, keep := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://localhost:%d", port), nil)
+		if err != nil {
+			t.Fatalf("unable to create request %v", err)
+		}
+
+		c := New()
+		c.ReturnLastResponseOnCancel = keep
+		c.Backoff = func(_ int) time.Duration { return 5 * time.Second }
+		go func() {
+			<-time.After(100 * time.Millisecond)
+			cancel()
+		}()
+
+		resp, err := c.Do(req)
+		if err != context.Canceled {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+		if resp == nil {
+			t.Fatal("response was unexpectedly nil")
+		}
+		body, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if keep {
+			if readErr != nil {
+				t.Errorf("unexpected error reading body %v", readErr)
+			}
+			if got, want := string(body), "500 Internal Server Error"; got != want {
+				t.Errorf("got body %q, want %q", got, want)
+			}
+		} else if readErr == nil {
+			t.Error("expected an error reading an already closed body")
+		}
+	}
+}
+
+func TestScheduleBackoff(t *testing.T) {
+	t.Parallel()
+
+	schedule := ScheduleBackoff(500*time.Millisecond, 2*time.Second, 10*time.Second)
+	for retry, want := range map[int]time.Duration{
+		1: 500 * time.Millisecond,
+		2: 2 * time.Second,
+		3: 10 * time.Second,
+		4: 10 * time.Second,
+		9: 10 * time.Second,
+	} {
+		if got := schedule(retry); got != want {
+			t.Errorf("retry %d: got %s, want %s", retry, got, want)
+		}
+	}
+
+	if got, want := ScheduleBackoff()(1), time.Duration(0); got != want {
+		t.Errorf("empty schedule: got %s, want %s", got, want)
+	}
+}
+
+func TestShouldContinue(t *testing.T) {
+	t.Parallel()
+
+	attempts := 0
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			attempts++
+			if attempts < 3 {
+				return &http.Response{StatusCode: http.StatusBadRequest, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}),
+	})
+	c.MaxRetries = 5
+	c.KeepLog = true
+	c.Backoff = func(_ int) time.Duration {
+		t.Error("Backoff should not be used when ShouldContinue is set")
+		return 0
+	}
+	var waits []time.Duration
+	c.ShouldContinue = func(attempt int, elapsed time.Duration, resp *http.Response, err error) (bool, time.Duration) {
+		if elapsed < 0 {
+			t.Errorf("got negative elapsed time %s", elapsed)
+		}
+		wait := time.Duration(attempt) * time.Millisecond
+		waits = append(waits, wait)
+		// retry the 400s that the default policy would give up on
+		return resp.StatusCode == http.StatusBadRequest, wait
+	}
+
+	resp, err := c.Get("http://localhost")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if got, want := attempts, 3; got != want {
+		t.Errorf("got %d attempts, want %d", got, want)
+	}
+	if got, want := len(waits), 3; got != want {
+		t.Errorf("got %d decisions, want %d", got, want)
+	}
+	if got, want := c.LogErrCount(), 2; got != want {
+		t.Errorf("got %d errors, want %d", got, want)
+	}
+}
+
+func TestMirrorTo(t *testing.T) {
+	t.Parallel()
+
+	const testContent = "TestMirrorTo"
+	mirrored := make(chan string, 1)
+	mirrorPort, closeMirror, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(body)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	if err != nil {
+		t.Fatal("unable to start mirror server", err)
+	}
+	defer closeMirror()
+
+	primaryPort, closePrimary, err := middlewareServer(always500RequestMiddleware())
+	if err != nil {
+		t.Fatal("unable to start primary server", err)
+	}
+	defer closePrimary()
+
+	c := New()
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.MirrorTo = fmt.Sprintf("http://localhost:%d/mirror", mirrorPort)
+	mirrorStatus := make(chan int, 1)
+	c.OnMirrorResponse = func(resp *http.Response, err error) {
+		if err != nil {
+			t.Errorf("unexpected mirror error %v", err)
+			mirrorStatus <- 0
+			return
+		}
+		mirrorStatus <- resp.StatusCode
+	}
+
+	resp, err := c.Post(fmt.Sprintf("http://localhost:%d/users", primaryPort), "text/plain", strings.NewReader(testContent))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusInternalServerError; got != want {
+		t.Errorf("got primary status %d, want %d", got, want)
+	}
+	c.Wait()
+
+	if got, want := <-mirrored, "POST /mirror/users "+testContent; got != want {
+		t.Errorf("got mirrored request %q, want %q", got, want)
+	}
+	if got, want := <-mirrorStatus, http.StatusTeapot; got != want {
+		t.Errorf("got mirror status %d, want %d", got, want)
+	}
+	select {
+	case r := <-mirrored:
+		t.Errorf("mirrored request should not be retried, got %q", r)
+	default:
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var urls []string
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			urls = append(urls, r.URL.String())
+			mu.Unlock()
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+	c.BaseURL = "http://api.example.com/v1/"
+
+	if _, err := c.Get("users"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := c.Post("/health", "text/plain", strings.NewReader("")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := c.Head("http://other.example.com/absolute"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "users/1?full=true", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	if _, err := c.Do(req); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got, want := req.URL.String(), "users/1?full=true"; got != want {
+		t.Errorf("caller's request was modified, got %q, want %q", got, want)
+	}
+
+	want := []string{
+		"http://api.example.com/v1/users",
+		"http://api.example.com/health",
+		"http://other.example.com/absolute",
+		"http://api.example.com/v1/users/1?full=true",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(urls, " "); got != strings.Join(want, " ") {
+		t.Errorf("got urls %v, want %v", urls, want)
+	}
+}
+
+type headerMutatingSigner struct{}
+
+func (headerMutatingSigner) Sign(r *http.Request) error {
+	r.Header.Set("X-Signature", strconv.FormatInt(time.Now().UnixNano(), 10))
+	r.Header.Add("X-Attempt", "1")
+	r.Trailer.Set("X-Checksum", "abc")
+	return nil
+}
+
+// TestConcurrentDoIndependentHeaders is most useful when run with -race
+func TestConcurrentDoIndependentHeaders(t *testing.T) {
+	t.Parallel()
+
+	for _, concurrency := range []int{1, 5} {
+		c := NewExtendedClient(&http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				for range r.Header {
+				}
+				for range r.Trailer {
+				}
+				return nil, fmt.Errorf("always fail")
+			}),
+		})
+		c.Concurrency = concurrency
+		c.MaxRetries = 3
+		c.Backoff = func(_ int) time.Duration { return 0 }
+		c.Signer = headerMutatingSigner{}
+
+		req, err := http.NewRequest(http.MethodGet, "http://localhost", nil)
+		if err != nil {
+			t.Fatalf("unable to create request %v", err)
+		}
+		req.Header.Set("Accept", "text/plain")
+		req.Trailer = http.Header{}
+
+		if _, err := c.Do(req); err == nil {
+			t.Fatalf("concurrency %d: expected to get an error", concurrency)
+		}
+		c.Wait()
+
+		if got := req.Header.Get("X-Signature"); got != "" {
+			t.Errorf("concurrency %d: caller's request headers were modified, got X-Signature %q", concurrency, got)
+		}
+		if got := req.Trailer.Get("X-Checksum"); got != "" {
+			t.Errorf("concurrency %d: caller's request trailers were modified, got X-Checksum %q", concurrency, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	c := New()
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error for default client %v", err)
+	}
+
+	c.MaxRetries = 0
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error for MaxRetries 0 %v", err)
+	}
+
+	c.MaxRetries = -1
+	if err := c.Validate(); err != ErrInvalidMaxRetries {
+		t.Errorf("got error %v, want %v", err, ErrInvalidMaxRetries)
+	}
+	c.MaxRetries = 3
+
+	c.Concurrency = 0
+	if err := c.Validate(); err != ErrInvalidConcurrency {
+		t.Errorf("got error %v, want %v", err, ErrInvalidConcurrency)
+	}
+	c.Concurrency = 3
+
+	c.Backoff = nil
+	if err := c.Validate(); err != ErrMissingBackoff {
+		t.Errorf("got error %v, want %v", err, ErrMissingBackoff)
+	}
+	c.ShouldContinue = func(_ int, _ time.Duration, _ *http.Response, _ error) (bool, time.Duration) { return false, 0 }
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error with ShouldContinue and no Backoff %v", err)
+	}
+
+	c.ConcurrencySafe = func(string) bool { return true }
+	if err := c.Validate(); err != ErrUnsafeConcurrency {
+		t.Errorf("got error %v, want %v", err, ErrUnsafeConcurrency)
+	}
+	c.Concurrency = 1
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error without Concurrency %v", err)
+	}
+}
+
+func TestZeroConcurrencySendsOneRequest(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+	c.Concurrency = 0
+
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("got %d calls, want 1", got)
+	}
+}
+
+func TestZeroMaxRetriesTriesOnce(t *testing.T) {
+	t.Parallel()
+
+	attempts := 0
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			attempts++
+			return nil, fmt.Errorf("always fail")
+		}),
+	})
+	c.MaxRetries = 0
+
+	if _, err := c.Get("http://localhost"); err == nil {
+		t.Fatal("expected to get an error")
+	}
+	if got, want := attempts, 1; got != want {
+		t.Errorf("got %d attempts, want %d", got, want)
+	}
+}
+
+// countingListener counts the bytes read from all accepted connections
+type countingListener struct {
+	net.Listener
+	read *int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	return countingConn{Conn: conn, read: l.read}, err
+}
+
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+func TestExpectContinueRetriesDoNotResendBody(t *testing.T) {
+	t.Parallel()
+
+	var bytesRead int64
+	var expects int64
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal("unable to secure listener", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Expect") == "100-continue" {
+			atomic.AddInt64(&expects, 1)
+		}
+		// reject without reading the body so that 100 Continue is never sent
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})}
+	go server.Serve(countingListener{Listener: l, read: &bytesRead})
+	defer server.Close()
+
+	c := NewExtendedClient(&http.Client{
+		Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second},
+	})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	body := strings.Repeat("a", 1<<20)
+	req, err := http.NewRequest(http.MethodPost, "http://"+l.Addr().String(), strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	req.Header.Set("Expect", "100-continue")
+
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusServiceUnavailable; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if got, want := atomic.LoadInt64(&expects), int64(c.MaxRetries); got != want {
+		t.Errorf("got %d attempts with an Expect header, want %d", got, want)
+	}
+	if got := atomic.LoadInt64(&bytesRead); got >= int64(len(body)) {
+		t.Errorf("server read %d bytes, the body should not have been uploaded", got)
+	}
+}
+
+func TestGetQuorum(t *testing.T) {
+	t.Parallel()
+
+	var requests int64
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail every other request so that some of them need a retry
+		if atomic.AddInt64(&requests, 1)%2 == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("OK"))
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	const n = 3
+	resps, errs := c.GetQuorum(fmt.Sprintf("http://localhost:%d", port), n)
+	if got, want := len(resps), n; got != want {
+		t.Fatalf("got %d responses, want %d", got, want)
+	}
+	for i := range resps {
+		if errs[i] != nil {
+			t.Errorf("unexpected error for request %d: %v", i, errs[i])
+			continue
+		}
+		body, err := ioutil.ReadAll(resps[i].Body)
+		resps[i].Body.Close()
+		if err != nil {
+			t.Errorf("unable to read body of request %d: %v", i, err)
+		}
+		if got, want := string(body), "OK"; got != want {
+			t.Errorf("got body %q for request %d, want %q", got, i, want)
+		}
+	}
+	if got := atomic.LoadInt64(&requests); got < n {
+		t.Errorf("got %d requests, want at least %d", got, n)
+	}
+}
+
+// streamReader hides any other methods of the wrapped reader, like a live network stream would
+type streamReader struct {
+	r io.Reader
+}
+
+func TestGetQuorumWithoutRequests(t *testing.T) {
+	t.Parallel()
+
+	c := New()
+	for _, n := range []int{0, -1} {
+		resps, errs := c.GetQuorum("http://example.com", n)
+		if len(resps) != 0 || len(errs) != 0 {
+			t.Errorf("n %d: got %d responses and %d errors, want none", n, len(resps), len(errs))
+		}
+	}
+}
+
+func (s streamReader) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
+
+func TestNoBufferBody(t *testing.T) {
+	t.Parallel()
+
+	const testContent = "TestNoBufferBody"
+	serverReqErrCh := make(chan error, 9)
+	port, closeFn, err := middlewareServer(
+		contentVerificationMiddleware(serverReqErrCh, testContent),
+		always500RequestMiddleware(),
+	)
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+	url := fmt.Sprintf("http://localhost:%d", port)
+
+	c := New()
+	c.MaxRetries = 3
+	c.KeepLog = true
+	c.NoBufferBody = true
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	// seekable bodies are replayed by seeking
+	resp, err := c.Post(url, "text/plain", strings.NewReader(testContent))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	// bodies with a GetBody are replayed with it
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(testContent))
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	if got, want := c.LogErrCount(), 2*c.MaxRetries; got != want {
+		t.Errorf("got %d attempts, want %d", got, want)
+	}
+
+	// anything else is only sent once
+	resp, err = c.Post(url, "text/plain", streamReader{strings.NewReader(testContent)})
+	if !errors.Is(err, ErrUnreplayableBody) {
+		t.Errorf("got error %v, want %v", err, ErrUnreplayableBody)
+	}
+	if resp == nil {
+		t.Error("response was unexpectedly nil")
+	} else {
+		resp.Body.Close()
+	}
+	if got, want := c.LogErrCount(), 2*c.MaxRetries+1; got != want {
+		t.Errorf("got %d attempts, want %d", got, want)
+	}
+
+	close(serverReqErrCh)
+	for v := range serverReqErrCh {
+		if v != nil {
+			t.Errorf("unexpected error occurred when server processed request: %v", v)
+		}
+	}
+}
+
+type attemptsError struct {
+	url      string
+	attempts int
+	err      error
+}
+
+func (e *attemptsError) Error() string {
+	return fmt.Sprintf("%s failed after %d attempts: %v", e.url, e.attempts, e.err)
+}
+
+func TestFinalErrorFunc(t *testing.T) {
+	t.Parallel()
+
+	transportErr := errors.New("always fail")
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return nil, transportErr
+		}),
+	})
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.FinalErrorFunc = func(lastResp *http.Response, lastErr error, attempts int) error {
+		if lastResp != nil {
+			t.Errorf("got unexpected response %v", lastResp)
+		}
+		return &attemptsError{url: "http://localhost", attempts: attempts, err: lastErr}
+	}
+
+	_, err := c.Get("http://localhost")
+	var attemptsErr *attemptsError
+	if !errors.As(err, &attemptsErr) {
+		t.Fatalf("got error %v, want an *attemptsError", err)
+	}
+	if got, want := attemptsErr.attempts, c.MaxRetries; got != want {
+		t.Errorf("got %d attempts, want %d", got, want)
+	}
+	if !errors.Is(attemptsErr.err, transportErr) {
+		t.Errorf("got wrapped error %v, want %v", attemptsErr.err, transportErr)
+	}
+}
+
+func TestMaxBodyMemorySpillsToDisk(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pester-test-")
+	if err != nil {
+		t.Fatal("unable to create temp dir", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmpDir)
+
+	testContent := strings.Repeat("TestMaxBodyMemorySpillsToDisk", 100)
+	serverReqErrCh := make(chan error, 3)
+	spilled := make(chan int, 3)
+	port, closeFn, err := middlewareServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			files, _ := ioutil.ReadDir(tmpDir)
+			spilled <- len(files)
+		}),
+		contentVerificationMiddleware(serverReqErrCh, testContent),
+		always500RequestMiddleware(),
+	)
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxRetries = cap(serverReqErrCh)
+	c.MaxBodyMemory = 64
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	url := fmt.Sprintf("http://localhost:%d", port)
+	resp, err := c.Post(url, "text/plain", strings.NewReader(testContent))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	c.Wait()
+
+	close(spilled)
+	for n := range spilled {
+		if n != 1 {
+			t.Errorf("got %d spilled files during the request, want 1", n)
+		}
+	}
+	close(serverReqErrCh)
+	for v := range serverReqErrCh {
+		if v != nil {
+			t.Errorf("unexpected error occurred when server processed request: %v", v)
+		}
+	}
+
+	// the file is removed in the background once all requests are back
+	deadline := time.Now().Add(time.Second)
+	for {
+		files, err := ioutil.ReadDir(tmpDir)
+		if err != nil {
+			t.Fatal("unable to read temp dir", err)
+		}
+		if len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d leftover files, want 0", len(files))
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+
+	// small bodies are still kept in memory
+	smallSpilled := make(chan int, 1)
+	smallPort, closeSmall, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		files, _ := ioutil.ReadDir(tmpDir)
+		smallSpilled <- len(files)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeSmall()
+	if resp, err = c.Post(fmt.Sprintf("http://localhost:%d", smallPort), "text/plain", strings.NewReader("small")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if n := <-smallSpilled; n != 0 {
+		t.Errorf("got %d spilled files for a small body, want 0", n)
+	}
+}
+
+func TestRetryIdentityOnGzipError(t *testing.T) {
+	t.Parallel()
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(strings.Repeat("hello ", 100)))
+	zw.Close()
+	// cut the stream short like a misbehaving proxy
+	corrupted := compressed.Bytes()[:compressed.Len()/2]
+
+	acceptEncodings := make(chan string, 4)
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncodings <- r.Header.Get("Accept-Encoding")
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(corrupted)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxRetries = 1
+	c.KeepLog = true
+	c.RetryIdentityOnGzipError = true
+
+	resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error reading body: %v", err)
+	}
+	if got, want := string(body), "hello"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+	got := []string{<-acceptEncodings, <-acceptEncodings}
+	if want := []string{"gzip", "identity"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got Accept-Encoding headers %v, want %v", got, want)
+	}
+	if got, want := c.LogErrCount(), 1; got != want {
+		t.Errorf("got %d errors, want %d", got, want)
+	}
+
+	// the fallback must not stick to a request the caller reuses
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d", port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if got := req.Header.Get("Accept-Encoding"); got != "" {
+		t.Errorf("got Accept-Encoding %q on the caller's request, want none", got)
+	}
+}
+
+func TestSingleFlight(t *testing.T) {
+	t.Parallel()
+
+	var requests int64
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		<-time.After(200 * time.Millisecond)
+		w.Write([]byte("OK"))
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.SingleFlight = true
+	url := fmt.Sprintf("http://localhost:%d", port)
+
+	const callers = 5
+	errCh := make(chan error, callers)
+	wg := &sync.WaitGroup{}
+	block := make(chan struct{})
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-block
+			resp, err := c.Get(url)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				errCh <- err
+			} else if string(body) != "OK" {
+				errCh <- fmt.Errorf("got body %q, want %q", string(body), "OK")
+			}
+		}()
+	}
+	close(block)
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Error(err)
+	}
+	if got, want := atomic.LoadInt64(&requests), int64(1); got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+
+	// once the call is done, the next one goes out again
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if got, want := atomic.LoadInt64(&requests), int64(2); got != want {
+		t.Errorf("got %d requests, want %d", got, want)
+	}
+}
+
+func TestNextProxy(t *testing.T) {
+	t.Parallel()
+
+	proxied := make(chan string, 2)
+	badProxyPort, closeBad, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- "bad " + r.URL.String()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeBad()
+	goodProxyPort, closeGood, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- "good " + r.URL.String()
+		w.Write([]byte("OK"))
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeGood()
+
+	c := New()
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.NextProxy = func(attempt int) (*url.URL, error) {
+		if attempt == 1 {
+			return url.Parse(fmt.Sprintf("http://localhost:%d", badProxyPort))
+		}
+		return url.Parse(fmt.Sprintf("http://localhost:%d", goodProxyPort))
+	}
+
+	resp, err := c.Get("http://example.com/scrape")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if got, want := <-proxied, "bad http://example.com/scrape"; got != want {
+		t.Errorf("got first attempt %q, want %q", got, want)
+	}
+	if got, want := <-proxied, "good http://example.com/scrape"; got != want {
+		t.Errorf("got second attempt %q, want %q", got, want)
+	}
+
+	c = NewExtendedClient(&http.Client{Transport: roundTripperFunc(http.DefaultTransport.RoundTrip)})
+	c.NextProxy = func(attempt int) (*url.URL, error) { return nil, nil }
+	if _, err := c.Get("http://example.com"); err != ErrProxyRotationUnsupported {
+		t.Errorf("got error %v, want %v", err, ErrProxyRotationUnsupported)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	t.Parallel()
+
+	var attempts int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				started <- struct{}{}
+				<-release
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+
+	inFlight := make(chan error, 1)
+	go func() {
+		resp, err := c.Get("http://example.com")
+		if err == nil {
+			resp.Body.Close()
+		}
+		inFlight <- err
+	}()
+	<-started
+
+	c.Pause()
+	if _, err := c.Get("http://example.com"); err != ErrClientPaused {
+		t.Errorf("got error %v while paused, want %v", err, ErrClientPaused)
+	}
+
+	close(release)
+	if err := <-inFlight; err != nil {
+		t.Errorf("unexpected error for in flight call %v", err)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+
+	c.Resume()
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error after resume %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestTrailersSurviveRetries(t *testing.T) {
+	t.Parallel()
+
+	var attempts int32
+	trailers := make(chan string, 2)
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		trailers <- r.Trailer.Get("X-Checksum")
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://localhost:%d", port), ioutil.NopCloser(strings.NewReader("payload")))
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	req.Trailer = http.Header{"X-Checksum": []string{"abc123"}}
+
+	c := New()
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	if got := atomic.LoadInt32(&attempts); got != 2 {
+		t.Fatalf("got %d attempts, want 2", got)
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-trailers; got != "abc123" {
+			t.Errorf("attempt %d got trailer %q, want %q", i+1, got, "abc123")
+		}
+	}
+}
+
+func TestInitialJitter(t *testing.T) {
+	t.Parallel()
+
+	var attempts int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&attempts, 1)
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+	c.InitialJitter = 20 * time.Millisecond
+
+	start := time.Now()
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("call took %s, expected at most InitialJitter of %s", elapsed, c.InitialJitter)
+	}
+
+	c.InitialJitter = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	if _, err := c.Do(req); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+}
+
+func TestLoadHeaderScalesBackoff(t *testing.T) {
+	t.Parallel()
+
+	c := New()
+	c.Backoff = func(_ int) time.Duration { return 100 * time.Millisecond }
+	c.LoadHeader = "X-Server-Load"
+
+	tests := []struct {
+		load string
+		want time.Duration
+	}{
+		{"", 100 * time.Millisecond},
+		{"garbage", 100 * time.Millisecond},
+		{"NaN", 100 * time.Millisecond},
+		{"0", 100 * time.Millisecond},
+		{"0.5", 150 * time.Millisecond},
+		{"1.0", 200 * time.Millisecond},
+		{"7", 200 * time.Millisecond},
+		{"-3", 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.load != "" {
+			resp.Header.Set("X-Server-Load", tt.load)
+		}
+		if got := c.backoff(1, resp); got != tt.want {
+			t.Errorf("load %q got backoff %s, want %s", tt.load, got, tt.want)
+		}
+	}
+
+	if got := c.backoff(1, nil); got != 100*time.Millisecond {
+		t.Errorf("got backoff %s without a response, want %s", got, 100*time.Millisecond)
+	}
+}
+
+func TestRetryBudgetRatio(t *testing.T) {
+	t.Parallel()
+
+	var attempts int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&attempts, 1)
+			return nil, fmt.Errorf("always fail")
+		}),
+	})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.RetryBudgetRatio = 0.5
+
+	// 10 calls make 10 attempts and 14 retries: the burst of 10, plus half a retry earned
+	// back by each call after the first
+	for i := 0; i < 10; i++ {
+		if _, err := c.Get("http://example.com"); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if got := atomic.LoadInt32(&attempts); got != 24 {
+		t.Errorf("got %d attempts, want 24", got)
+	}
+
+	// with the budget exhausted, new calls are only retried as the budget is earned back
+	atomic.StoreInt32(&attempts, 0)
+	for i := 0; i < 4; i++ {
+		c.Get("http://example.com")
+	}
+	if got := atomic.LoadInt32(&attempts); got != 6 {
+		t.Errorf("got %d attempts after exhausting the budget, want 6", got)
+	}
+}
+
+func TestAttemptAndRequestIDHeaders(t *testing.T) {
+	t.Parallel()
+
+	var attempts, requestIDs []string
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			attempts = append(attempts, r.Header.Get("X-Attempt"))
+			requestIDs = append(requestIDs, r.Header.Get("X-Request-ID"))
+			return nil, fmt.Errorf("always fail")
+		}),
+	})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.AttemptHeader = "X-Attempt"
+	c.RequestIDHeader = "X-Request-ID"
+
+	c.Get("http://example.com")
+	if got, want := strings.Join(attempts, ","), "1,2,3"; got != want {
+		t.Errorf("got attempt headers %s, want %s", got, want)
+	}
+	if requestIDs[0] == "" || requestIDs[0] != requestIDs[1] || requestIDs[1] != requestIDs[2] {
+		t.Errorf("got request IDs %v, want the same ID for every attempt", requestIDs)
+	}
+
+	firstID := requestIDs[0]
+	attempts, requestIDs = nil, nil
+	c.Get("http://example.com")
+	if requestIDs[0] == firstID {
+		t.Errorf("got request ID %s for two calls, want a new ID per call", firstID)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	req.Header.Set("X-Request-ID", "caller-id")
+	requestIDs = nil
+	c.Do(req)
+	if requestIDs[0] != "caller-id" {
+		t.Errorf("got request ID %s, want the caller's ID", requestIDs[0])
+	}
+	if got := req.Header.Get("X-Attempt"); got != "" {
+		t.Errorf("got attempt header %s on the caller's request, want none", got)
+	}
+}
+
+func TestSelectBest(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			status := http.StatusServiceUnavailable
+			switch atomic.AddInt32(&calls, 1) {
+			case 1:
+				// a fast 503
+			case 2:
+				time.Sleep(20 * time.Millisecond)
+				status = http.StatusOK
+			default:
+				// too slow to make the window
+				time.Sleep(time.Second)
+			}
+			return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+	c.Concurrency = 3
+	c.MaxRetries = 1
+
+	var got []Result
+	c.SelectBestWindow = 200 * time.Millisecond
+	c.SelectBest = func(results []Result) int {
+		got = results
+		for i, r := range results {
+			if r.Err == nil && r.Response.StatusCode == http.StatusOK {
+				return i
+			}
+		}
+		return 0
+	}
+
+	start := time.Now()
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d results, want the 2 within the window", len(got))
+	}
+	if got[0].Latency > got[1].Latency {
+		t.Errorf("got latencies %s and %s, want them in order of arrival", got[0].Latency, got[1].Latency)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("call took %s, want it to stop waiting after SelectBestWindow", elapsed)
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	t.Parallel()
+
+	var methods, overrides []string
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			methods = append(methods, r.Method)
+			overrides = append(overrides, r.Header.Get("X-HTTP-Method-Override"))
+			return &http.Response{StatusCode: http.StatusInternalServerError, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.MethodOverride = true
+
+	req, err := http.NewRequest(http.MethodDelete, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	c.Do(req)
+	if got, want := strings.Join(methods, ","), "POST,POST"; got != want {
+		t.Errorf("got methods %s, want %s", got, want)
+	}
+	if got, want := strings.Join(overrides, ","), "DELETE,DELETE"; got != want {
+		t.Errorf("got overrides %s, want %s", got, want)
+	}
+	if req.Method != http.MethodDelete || req.Header.Get("X-HTTP-Method-Override") != "" {
+		t.Error("expected the caller's request to be left untouched")
+	}
+
+	methods, overrides = nil, nil
+	c.Get("http://example.com")
+	if got, want := strings.Join(methods, ","), "GET,GET"; got != want {
+		t.Errorf("got methods %s, want %s", got, want)
+	}
+	if got, want := strings.Join(overrides, ","), ","; got != want {
+		t.Errorf("got overrides %q, want none", got)
+	}
+}
+
+func TestRetryIfSlowerThan(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		delays    []time.Duration
+		wantBody  string
+		wantCalls int32
+		// config limits retries, which the slow retry is subject to like any other
+		config  func(c *Client)
+		timeout time.Duration
+	}{
+		{"fast retry wins", []time.Duration{50 * time.Millisecond, 0}, "response-2", 2, nil, 0},
+		{"slow retry falls back", []time.Duration{50 * time.Millisecond, 50 * time.Millisecond}, "response-1", 2, nil, 0},
+		{"fast attempt is kept", []time.Duration{0, 0}, "response-1", 1, nil, 0},
+		{"out of total attempts", []time.Duration{50 * time.Millisecond, 0}, "response-1", 1, func(c *Client) { c.MaxTotalAttempts = 1 }, 0},
+		{"out of retry budget", []time.Duration{50 * time.Millisecond, 0}, "response-1", 1, func(c *Client) {
+			c.RetryBudgetRatio = 0.1
+			c.retryBudgetSpent = retryBudgetBurst
+		}, 0},
+		{"no time for a retry", []time.Duration{100 * time.Millisecond, 0}, "response-1", 1, func(c *Client) { c.BudgetAwareBackoff = true }, 150 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+			c := NewExtendedClient(&http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					n := atomic.AddInt32(&calls, 1)
+					time.Sleep(tt.delays[n-1])
+					body := fmt.Sprintf("response-%d", n)
+					return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(body)), Request: r}, nil
+				}),
+			})
+			c.MaxRetries = 3
+			c.Backoff = func(_ int) time.Duration { return 0 }
+			c.RetryIfSlowerThan = 20 * time.Millisecond
+			if tt.config != nil {
+				tt.config(c)
+			}
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.Do(req.WithContext(ctx))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("unable to read body %v", err)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("got body %s, want %s", body, tt.wantBody)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestSetMaxBackoff(t *testing.T) {
+	t.Parallel()
+
+	c := New()
+	c.Backoff = func(i int) time.Duration { return time.Duration(i) * time.Second }
+
+	c.SetMaxBackoff(2 * time.Second)
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 2 * time.Second} {
+		if got := c.backoff(i+1, nil); got != want {
+			t.Errorf("attempt %d got backoff %s, want %s", i+1, got, want)
+		}
+	}
+
+	c.SetMaxBackoff(0)
+	if got := c.backoff(3, nil); got != 3*time.Second {
+		t.Errorf("got backoff %s without a max, want %s", got, 3*time.Second)
+	}
+}
+
+func TestReturnLastResponse(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if n := atomic.AddInt32(&calls, 1); n < 3 {
+				body := fmt.Sprintf("diagnostics-%d", n)
+				return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(strings.NewReader(body)), Request: r}, nil
+			}
+			return nil, fmt.Errorf("connection reset")
+		}),
+	})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	resp, err := c.Get("http://example.com")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if resp != nil {
+		t.Fatal("expected no response without ReturnLastResponse")
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	c.ReturnLastResponse = true
+	resp, err = c.Get("http://example.com")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if resp == nil {
+		t.Fatal("expected the last response")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read body %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "diagnostics-2" {
+		t.Errorf("got %d %s, want %d diagnostics-2", resp.StatusCode, body, http.StatusServiceUnavailable)
+	}
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	t.Parallel()
+
+	var headers []http.Header
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			headers = append(headers, r.Header.Clone())
+			return &http.Response{StatusCode: http.StatusInternalServerError, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.DefaultHeaders = http.Header{}
+	c.DefaultHeaders.Set("X-Api-Key", "secret")
+	c.DefaultHeaders.Set("Accept", "application/json")
+	c.DefaultHeaders.Set("Content-Type", "text/plain")
+
+	c.Post("http://example.com", "application/json", strings.NewReader("{}"))
+	if len(headers) != 2 {
+		t.Fatalf("got %d attempts, want 2", len(headers))
+	}
+	for i, h := range headers {
+		if h.Get("X-Api-Key") != "secret" || h.Get("Accept") != "application/json" {
+			t.Errorf("attempt %d is missing default headers: %v", i+1, h)
+		}
+		if got := h.Get("Content-Type"); got != "application/json" {
+			t.Errorf("attempt %d got Content-Type %s, want the body type", i+1, got)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	req.Header.Set("Accept", "text/html")
+	headers = nil
+	c.Do(req)
+	if got := headers[0].Get("Accept"); got != "text/html" {
+		t.Errorf("got Accept %s, want the caller's value", got)
+	}
+	if got := headers[0].Get("X-Api-Key"); got != "secret" {
+		t.Errorf("got X-Api-Key %s, want the default value", got)
+	}
+	if got := req.Header.Get("X-Api-Key"); got != "" {
+		t.Errorf("got X-Api-Key %s on the caller's request, want none", got)
+	}
+}
+
+// truncatedBody returns content and then fails as if the connection was cut
+type truncatedBody struct {
+	r io.Reader
+}
+
+func (b truncatedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b truncatedBody) Close() error { return nil }
+
+func TestValidatePostResponseBody(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			var body io.ReadCloser = ioutil.NopCloser(strings.NewReader("complete"))
+			if atomic.AddInt32(&calls, 1) == 1 {
+				body = truncatedBody{strings.NewReader("compl")}
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: body, Request: r}, nil
+		}),
+	})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.KeepLog = true
+	c.ValidatePostResponseBody = true
+
+	resp, err := c.Post("http://example.com", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read body %v", err)
+	}
+	if string(body) != "complete" {
+		t.Errorf("got body %s, want complete", body)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("got %d calls, want 2", got)
+	}
+	if c.LogErrCount() != 1 || !errors.Is(c.ErrLog[0].Err, ErrReadingResponseBody) {
+		t.Errorf("got log %v, want a single ErrReadingResponseBody", c.ErrLog)
+	}
+
+	// an unreplayable body is sent once, so its response is returned as is
+	atomic.StoreInt32(&calls, 0)
+	c.NoBufferBody = true
+	resp, err = c.Post("http://example.com", "text/plain", streamReader{strings.NewReader("payload")})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := ioutil.ReadAll(resp.Body); err != io.ErrUnexpectedEOF {
+		t.Errorf("got error %v reading the body, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestCallID(t *testing.T) {
+	t.Parallel()
+
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return nil, fmt.Errorf("always fail")
+		}),
+	})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.KeepLog = true
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Get("http://example.com")
+		}()
+	}
+	wg.Wait()
+
+	calls := map[string]int{}
+	for _, e := range c.ErrLog {
+		calls[e.CallID]++
+	}
+	if len(calls) != 2 {
+		t.Fatalf("got %d call IDs, want 2", len(calls))
+	}
+	for id, n := range calls {
+		if id == "" || n != 3 {
+			t.Errorf("got %d entries for call ID %q, want 3", n, id)
+		}
+	}
+}
+
+func TestMaxServerErrors(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&calls, 1)%2 == 1 {
+				return &http.Response{StatusCode: http.StatusBadGateway, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+			}
+			return nil, fmt.Errorf("connection reset")
+		}),
+	})
+	c.MaxRetries = 10
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.MaxServerErrors = 2
+
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+	// 502, transport error, 502
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("got %d calls, want 3", got)
+	}
+}
+
+func TestResponseAttemptHeader(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			status := http.StatusOK
+			if atomic.AddInt32(&calls, 1) < 3 {
+				status = http.StatusInternalServerError
+			}
+			return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(ResponseAttemptHeader); got != "3" {
+		t.Errorf("got %s %q, want 3", ResponseAttemptHeader, got)
+	}
+
+	resp, err = c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(ResponseAttemptHeader); got != "1" {
+		t.Errorf("got %s %q, want 1", ResponseAttemptHeader, got)
+	}
+
+	atomic.StoreInt32(&calls, -10)
+	resp, err = c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get(ResponseAttemptHeader) != "3" {
+		t.Errorf("got %d with %s %q, want the 500 of attempt 3", resp.StatusCode, ResponseAttemptHeader, resp.Header.Get(ResponseAttemptHeader))
+	}
+}
+
+func TestRetryOnDNSError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		err             error
+		retryOnDNSError bool
+		wantCalls       int32
+	}{
+		{"not found retried by default", &net.DNSError{Err: "no such host", Name: "typo.example", IsNotFound: true}, true, 3},
+		{"not found", &net.DNSError{Err: "no such host", Name: "typo.example", IsNotFound: true}, false, 1},
+		{"temporary", &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, false, 3},
+		{"other errors", fmt.Errorf("connection reset"), false, 3},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+			c := NewExtendedClient(&http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					atomic.AddInt32(&calls, 1)
+					return nil, &net.OpError{Op: "dial", Net: "tcp", Err: tt.err}
+				}),
+			})
+			c.MaxRetries = 3
+			c.Backoff = func(_ int) time.Duration { return 0 }
+			c.RetryOnDNSError = tt.retryOnDNSError
+
+			if _, err := c.Get("http://example.com"); err == nil {
+				t.Fatal("expected error")
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// closeCountingBody counts how often it is closed
+type closeCountingBody struct {
+	io.Reader
+	closes int32
+}
+
+func (b *closeCountingBody) Close() error {
+	atomic.AddInt32(&b.closes, 1)
+	return nil
+}
+
+func (b *closeCountingBody) Closes() int32 {
+	return atomic.LoadInt32(&b.closes)
+}
+
+// waitForCloses waits for the body to be closed, as some bodies are closed in the
+// background once all requests are back
+func waitForCloses(b *closeCountingBody) int32 {
+	deadline := time.Now().Add(time.Second)
+	for b.Closes() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// give a second close a chance to happen
+	time.Sleep(10 * time.Millisecond)
+	return b.Closes()
+}
+
+func TestCallerBodyClosedOnce(t *testing.T) {
+	t.Parallel()
+
+	// the transport closes request bodies, like the http.Transport does
+	transport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Body != nil {
+			ioutil.ReadAll(r.Body)
+			r.Body.Close()
+		}
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})
+
+	tests := []struct {
+		name      string
+		configure func(c *Client)
+		wantClose int32
+	}{
+		{"buffered", func(c *Client) {}, 1},
+		{"spilled", func(c *Client) { c.MaxBodyMemory = 1 }, 1},
+		{"unreplayable", func(c *Client) { c.NoBufferBody = true }, 1},
+		{"paused", func(c *Client) { c.Pause() }, 1},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := NewExtendedClient(&http.Client{Transport: transport})
+			c.MaxRetries = 2
+			c.Backoff = func(_ int) time.Duration { return 0 }
+			tt.configure(c)
+
+			body := &closeCountingBody{Reader: strings.NewReader("payload")}
+			req, err := http.NewRequest(http.MethodPost, "http://example.com", body)
+			if err != nil {
+				t.Fatalf("unable to create request %v", err)
+			}
+			c.Do(req)
+			if got := waitForCloses(body); got != tt.wantClose {
+				t.Errorf("got %d closes, want %d", got, tt.wantClose)
+			}
+		})
+	}
+
+	t.Run("post", func(t *testing.T) {
+		t.Parallel()
+
+		c := NewExtendedClient(&http.Client{Transport: transport})
+		c.Backoff = func(_ int) time.Duration { return 0 }
+
+		body := &closeCountingBody{Reader: strings.NewReader("payload")}
+		c.Post("http://example.com", "text/plain", body)
+		if got := body.Closes(); got != 0 {
+			t.Errorf("got %d closes without CloseCallerBody, want 0", got)
+		}
+
+		c.CloseCallerBody = true
+		body = &closeCountingBody{Reader: strings.NewReader("payload")}
+		c.Post("http://example.com", "text/plain", body)
+		if got := waitForCloses(body); got != 1 {
+			t.Errorf("got %d closes with CloseCallerBody, want 1", got)
+		}
+	})
+}
+
+func TestConcurrentLosersCancelled(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			delay := 5 * time.Second
+			if atomic.AddInt32(&calls, 1) == 1 {
+				delay = 10 * time.Millisecond
+			}
+			select {
+			case <-time.After(delay):
+				return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("winner")), Request: r}, nil
+			case <-r.Context().Done():
+				return nil, r.Context().Err()
+			}
+		}),
+	})
+	c.Concurrency = 5
+	c.MaxRetries = 1
+
+	start := time.Now()
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c.Wait()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("losers took %s to finish, want them cancelled", elapsed)
+	}
+
+	if got := atomic.LoadInt32(&c.cancelledLosers); got != 4 {
+		t.Errorf("got %d cancelled losers, want 4", got)
+	}
+	if got := atomic.LoadInt32(&c.completedLosers); got != 0 {
+		t.Errorf("got %d completed losers, want 0", got)
+	}
+
+	// the winner is left alone until its body is closed
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "winner" {
+		t.Errorf("got body %q and error %v, want the winner's body", body, err)
+	}
+	resp.Body.Close()
+	if err := resp.Request.Context().Err(); err != context.Canceled {
+		t.Errorf("got context error %v after closing the body, want %v", err, context.Canceled)
+	}
+}
+
+func TestURLRedactor(t *testing.T) {
+	t.Parallel()
+
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return nil, fmt.Errorf("connection reset")
+		}),
+	})
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.KeepLog = true
+	c.URLRedactor = func(u string) string {
+		return strings.Replace(u, "token=secret", "token=[REDACTED]", -1)
+	}
+
+	_, err := c.Get("http://example.com/path?token=secret")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "token=secret") {
+		t.Errorf("got error %v, want the returned error left untouched", err)
+	}
+
+	if c.LogErrCount() != 2 {
+		t.Fatalf("got %d log entries, want 2", c.LogErrCount())
+	}
+	if log := c.LogString(); strings.Contains(log, "secret") || !strings.Contains(log, "token=[REDACTED]") {
+		t.Errorf("got log %q, want the token redacted", log)
+	}
+	if urlErr, ok := c.ErrLog[0].Err.(*url.Error); !ok || urlErr.Err.Error() != "connection reset" {
+		t.Errorf("got logged error %#v, want a *url.Error wrapping the original error", c.ErrLog[0].Err)
+	}
+}
+
+func TestRetryErrorPattern(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err       string
+		wantCalls int32
+	}{
+		{"read tcp: connection reset by peer", 3},
+		{"x509: certificate signed by unknown authority", 1},
+	}
+	for _, tt := range tests {
+		var calls int32
+		c := NewExtendedClient(&http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				atomic.AddInt32(&calls, 1)
+				return nil, errors.New(tt.err)
+			}),
+		})
+		c.MaxRetries = 3
+		c.Backoff = func(_ int) time.Duration { return 0 }
+		c.RetryErrorPattern = regexp.MustCompile(`connection reset|EOF`)
+
+		if _, err := c.Get("http://example.com"); err == nil {
+			t.Fatal("expected error")
+		}
+		if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+			t.Errorf("%q got %d calls, want %d", tt.err, got, tt.wantCalls)
+		}
+	}
+}
+
+func TestHTTPSOnly(t *testing.T) {
+	t.Parallel()
+
+	var calls, checks int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}
+			switch r.URL.Path {
+			case "/downgrade":
+				resp.StatusCode = http.StatusFound
+				resp.Header.Set("Location", "http://example.com/")
+			case "/upgrade":
+				resp.StatusCode = http.StatusFound
+				resp.Header.Set("Location", "https://example.com/")
+			}
+			return resp, nil
+		}),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			atomic.AddInt32(&checks, 1)
+			return nil
+		},
+	})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.HTTPSOnly = true
+
+	_, err := c.Get("https://example.com/downgrade")
+	if !errors.Is(err, ErrInsecureRedirect) {
+		t.Errorf("got error %v, want %v", err, ErrInsecureRedirect)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("got %d calls, want 1 as insecure redirects are not retried", got)
+	}
+	if got := atomic.LoadInt32(&checks); got != 1 {
+		t.Errorf("got %d calls to CheckRedirect, want 1", got)
+	}
+
+	resp, err := c.Get("http://example.com/upgrade")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.String() != "https://example.com/" {
+		t.Errorf("got final URL %s, want https://example.com/", resp.Request.URL)
+	}
+}
+
+func TestAcceptFallbacks(t *testing.T) {
+	t.Parallel()
+
+	var accepts []string
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			accepts = append(accepts, r.Header.Get("Accept"))
+			status := http.StatusNotAcceptable
+			if r.Header.Get("Accept") == "application/xml" {
+				status = http.StatusOK
+			}
+			return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+	c.MaxRetries = 5
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.AcceptFallbacks = []string{"application/json", "application/xml", "*/*"}
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	req.Header.Set("Accept", "application/vnd.example+json")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got, want := strings.Join(accepts, ","), "application/vnd.example+json,application/json,application/xml"; got != want {
+		t.Errorf("got Accept headers %s, want %s", got, want)
+	}
+	if got := req.Header.Get("Accept"); got != "application/vnd.example+json" {
+		t.Errorf("got Accept %s on the caller's request, want it untouched", got)
+	}
+
+	// once the fallbacks run out, the 406 is returned
+	accepts = nil
+	c.AcceptFallbacks = []string{"text/plain"}
+	resp, err = c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotAcceptable || len(accepts) != 2 {
+		t.Errorf("got status %d after %d attempts, want %d after 2", resp.StatusCode, len(accepts), http.StatusNotAcceptable)
+	}
+}
+
+func TestGetBytes(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			var body io.ReadCloser = ioutil.NopCloser(strings.NewReader("complete"))
+			if atomic.AddInt32(&calls, 1) == 1 {
+				body = truncatedBody{strings.NewReader("compl")}
+			}
+			return &http.Response{StatusCode: http.StatusAccepted, Body: body, Request: r}, nil
+		}),
+	})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	body, status, err := c.GetBytes("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if string(body) != "complete" || status != http.StatusAccepted {
+		t.Errorf("got %d %s, want %d complete", status, body, http.StatusAccepted)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("got %d calls, want 2", got)
+	}
+
+	c = NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return nil, fmt.Errorf("connection refused")
+		}),
+	})
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	if body, status, err := c.GetBytes("http://example.com"); err == nil || body != nil || status != 0 {
+		t.Errorf("got %d %s %v, want only an error", status, body, err)
+	}
+}
+
+func TestMaxInFlightCalls(t *testing.T) {
+	t.Parallel()
+
+	var inFlight, maxInFlight int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+	c.MaxInFlightCalls = 2
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, err := c.Get("http://example.com"); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&maxInFlight); got != 2 {
+		t.Errorf("got at most %d calls in flight, want 2", got)
+	}
+
+	// a call waiting for a slot gives up once its context is done
+	c.callSlots <- struct{}{}
+	c.callSlots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	if _, err := c.Do(req); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+type spanContextKey struct{}
+
+func TestStartSpan(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if name, _ := r.Context().Value(spanContextKey{}).(string); name == "" {
+				t.Error("expected the attempt to use the span's context")
+			}
+			switch atomic.AddInt32(&calls, 1) {
+			case 1:
+				return nil, fmt.Errorf("connection reset")
+			case 2:
+				return &http.Response{StatusCode: http.StatusBadGateway, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	var names []string
+	var errs []error
+	c.StartSpan = func(ctx context.Context, name string) (context.Context, func(err error)) {
+		names = append(names, name)
+		return context.WithValue(ctx, spanContextKey{}, name), func(err error) {
+			errs = append(errs, err)
+		}
+	}
+
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	if got, want := strings.Join(names, ","), "GET attempt 1,GET attempt 2,GET attempt 3"; got != want {
+		t.Errorf("got spans %s, want %s", got, want)
+	}
+	if len(errs) != 3 {
+		t.Fatalf("got %d finished spans, want 3", len(errs))
+	}
+	var statusErr *StatusError
+	if errs[0] == nil || !errors.As(errs[1], &statusErr) || statusErr.StatusCode != http.StatusBadGateway || errs[2] != nil {
+		t.Errorf("got span errors %v, want an error, a 502 StatusError, and nil", errs)
+	}
+}
+
+func TestRetryAfterFunc(t *testing.T) {
+	t.Parallel()
+
+	c := New()
+	c.Backoff = func(_ int) time.Duration { return time.Second }
+	c.RetryAfterFunc = func(resp *http.Response) (time.Duration, bool) {
+		ms, err := strconv.Atoi(resp.Header.Get("X-Rate-Limit-Reset-Ms"))
+		if err != nil {
+			return 0, false
+		}
+		return time.Duration(ms) * time.Millisecond, true
+	}
+
+	resp := &http.Response{Header: http.Header{}}
+	if got := c.backoff(1, resp); got != time.Second {
+		t.Errorf("got backoff %s without the header, want %s", got, time.Second)
+	}
+	resp.Header.Set("X-Rate-Limit-Reset-Ms", "250")
+	if got := c.backoff(1, resp); got != 250*time.Millisecond {
+		t.Errorf("got backoff %s, want %s", got, 250*time.Millisecond)
+	}
+	if got := c.backoff(1, nil); got != time.Second {
+		t.Errorf("got backoff %s without a response, want %s", got, time.Second)
+	}
+
+	c.SetMaxBackoff(100 * time.Millisecond)
+	if got := c.backoff(1, resp); got != 100*time.Millisecond {
+		t.Errorf("got backoff %s, want it capped to %s", got, 100*time.Millisecond)
+	}
+}
+
+func TestRetryableStatusCodes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		status    int
+		codes     map[int]bool
+		want429   bool
+		wantCalls int32
+	}{
+		{http.StatusInternalServerError, nil, false, 3},
+		{http.StatusGatewayTimeout, nil, false, 3},
+		{http.StatusNotImplemented, nil, false, 1},
+		{http.StatusTooManyRequests, nil, false, 1},
+		{http.StatusTooManyRequests, nil, true, 3},
+		{http.StatusTooManyRequests, map[int]bool{http.StatusTooManyRequests: true}, false, 3},
+		{http.StatusInternalServerError, map[int]bool{http.StatusConflict: true}, false, 1},
+		{http.StatusConflict, map[int]bool{http.StatusConflict: true}, false, 3},
+	}
+	for _, tt := range tests {
+		var calls int32
+		c := NewExtendedClient(&http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				atomic.AddInt32(&calls, 1)
+				return &http.Response{StatusCode: tt.status, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+			}),
+		})
+		c.MaxRetries = 3
+		c.Backoff = func(_ int) time.Duration { return 0 }
+		c.RetryableStatusCodes = tt.codes
+		c.SetRetryOnHTTP429(tt.want429)
+
+		resp, err := c.Get("http://example.com")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp.Body.Close()
+		if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+			t.Errorf("status %d with codes %v got %d calls, want %d", tt.status, tt.codes, got, tt.wantCalls)
+		}
+	}
+}
+
+func TestPostBodyReplayedOnRedirect(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var bodies []string
+	var attempts int
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, r.URL.Path+":"+string(b))
+		switch {
+		case r.URL.Path == "/start":
+			http.Redirect(w, r, "/target", http.StatusTemporaryRedirect)
+		case attempts == 0:
+			attempts++
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	// streamReader is not one of the types http.NewRequest sets GetBody for
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d/start", port), streamReader{strings.NewReader("payload")})
+	if err != nil {
+		t.Fatalf("unable to create request %v", err)
+	}
+	if req.GetBody != nil {
+		t.Fatal("expected the request to have no GetBody")
+	}
+
+	c := New()
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	want := "/start:payload,/target:payload,/start:payload,/target:payload"
+	if got := strings.Join(bodies, ","); got != want {
+		t.Errorf("got bodies %s, want %s", got, want)
+	}
+}
+
+func TestOn1xx(t *testing.T) {
+	t.Parallel()
+
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	var mu sync.Mutex
+	var links []string
+	c := New()
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.On1xx = func(code int, header http.Header) {
+		mu.Lock()
+		defer mu.Unlock()
+		if code == http.StatusEarlyHints {
+			links = append(links, header.Get("Link"))
+		}
+	}
+
+	resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(links) != 2 || links[0] != "</style.css>; rel=preload; as=style" {
+		t.Errorf("got early hints %v, want one per attempt", links)
+	}
+}
+
+func TestRetryOnlyIfNothingWritten(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		method    string
+		err       error
+		wantCalls int32
+	}{
+		{http.MethodPost, errors.New("read tcp: connection reset by peer"), 1},
+		{http.MethodPost, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, 3},
+		{http.MethodPost, &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, 3},
+		{http.MethodPut, errors.New("read tcp: connection reset by peer"), 3},
+	}
+	for _, tt := range tests {
+		var calls int32
+		c := NewExtendedClient(&http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				atomic.AddInt32(&calls, 1)
+				return nil, tt.err
+			}),
+		})
+		c.MaxRetries = 3
+		c.Backoff = func(_ int) time.Duration { return 0 }
+		c.RetryOnlyIfNothingWritten = true
+
+		req, err := http.NewRequest(tt.method, "http://example.com", strings.NewReader("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Do(req); err == nil {
+			t.Fatal("expected error")
+		}
+		if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+			t.Errorf("%s %q: got %d calls, want %d", tt.method, tt.err, got, tt.wantCalls)
+		}
+	}
+}
+
+func TestDoAttemptsConcurrent(t *testing.T) {
+	t.Parallel()
+
+	// every call fails the number of times given in its X-Failures header
+	var mu sync.Mutex
+	seen := map[string]int{}
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failures, _ := strconv.Atoi(r.Header.Get("X-Failures"))
+		mu.Lock()
+		seen[r.Header.Get("X-Call")]++
+		n := seen[r.Header.Get("X-Call")]
+		mu.Unlock()
+		if n <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxRetries = 4
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			failures := i % 4
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d", port), nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("X-Call", strconv.Itoa(i))
+			req.Header.Set("X-Failures", strconv.Itoa(failures))
+
+			resp, attempts, err := c.DoAttempts(req)
+			if err != nil {
+				t.Errorf("call %d: unexpected error %v", i, err)
+				return
+			}
+			resp.Body.Close()
+			if attempts != failures+1 {
+				t.Errorf("call %d: got %d attempts, want %d", i, attempts, failures+1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// a call that runs out of retries reports all of its attempts
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d", port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Call", "exhausted")
+	req.Header.Set("X-Failures", "10")
+	resp, attempts, err := c.DoAttempts(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if attempts != c.MaxRetries {
+		t.Errorf("got %d attempts, want %d", attempts, c.MaxRetries)
+	}
+}
+
+func TestRetryOnEmptyBody(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		emptyFor  int32
+		status    int
+		wantCalls int32
+		wantBody  string
+	}{
+		{"empty then data", 2, http.StatusOK, 3, "data"},
+		{"always empty", 10, http.StatusOK, 3, ""},
+		{"no content", 10, http.StatusNoContent, 1, ""},
+	}
+	for _, tt := range tests {
+		var calls int32
+		port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) <= tt.emptyFor {
+				w.WriteHeader(tt.status)
+				return
+			}
+			w.Write([]byte("data"))
+		}))
+		if err != nil {
+			t.Fatal("unable to start server", err)
+		}
+
+		c := New()
+		c.MaxRetries = 3
+		c.Backoff = func(_ int) time.Duration { return 0 }
+		c.RetryOnEmptyBody = true
+
+		resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		closeFn()
+		if err != nil {
+			t.Fatalf("%s: unable to read body %v", tt.name, err)
+		}
+		if string(b) != tt.wantBody {
+			t.Errorf("%s: got body %q, want %q", tt.name, b, tt.wantBody)
+		}
+		if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+			t.Errorf("%s: got %d calls, want %d", tt.name, got, tt.wantCalls)
+		}
+	}
+}
+
+func TestBackoffByName(t *testing.T) {
+	t.Parallel()
+
+	s, err := BackoffByName("linear")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := s(3); got != 3*time.Second {
+		t.Errorf("got linear backoff %s, want 3s", got)
+	}
+	if _, err := BackoffByName("exponential_jitter"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if _, err := BackoffByName("fibonacci"); !errors.Is(err, ErrUnknownBackoff) {
+		t.Errorf("got error %v, want ErrUnknownBackoff", err)
+	}
+
+	RegisterBackoff("test_constant", func(_ int) time.Duration { return 42 * time.Millisecond })
+	s, err = BackoffByName("test_constant")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := s(1); got != 42*time.Millisecond {
+		t.Errorf("got registered backoff %s, want 42ms", got)
+	}
+}
+
+func TestResponseHook(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Internal", "secret")
+		w.Write([]byte("data"))
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	var hooked int32
+	c := New()
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.ResponseHook = func(resp *http.Response) (*http.Response, error) {
+		atomic.AddInt32(&hooked, 1)
+		resp.Header.Del("X-Internal")
+		return resp, nil
+	}
+
+	resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if got := atomic.LoadInt32(&hooked); got != 1 {
+		t.Errorf("got %d hook calls, want 1 for the winning response", got)
+	}
+	if got := resp.Header.Get("X-Internal"); got != "" {
+		t.Errorf("got X-Internal %q, want it removed by the hook", got)
+	}
+
+	hookErr := errors.New("cannot decrypt")
+	c.ResponseHook = func(resp *http.Response) (*http.Response, error) {
+		resp.Body.Close()
+		return nil, hookErr
+	}
+	resp, err = c.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != hookErr {
+		t.Errorf("got error %v, want the hook's error", err)
+	}
+	if resp != nil {
+		t.Error("got a response, want the one returned by the hook")
+	}
+}
+
+func TestPoll(t *testing.T) {
+	t.Parallel()
+
+	statuses := []int{503, 503, 200, 503, 200}
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&calls, 1)) - 1
+		if n >= len(statuses) {
+			n = len(statuses) - 1
+		}
+		w.WriteHeader(statuses[n])
+		fmt.Fprintf(w, "call %d", n)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	var mu sync.Mutex
+	var waits []int
+	c := New()
+	c.MaxRetries = 1
+	c.Backoff = func(retry int) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		waits = append(waits, retry)
+		return 0
+	}
+
+	stop := errors.New("stop")
+	var bodies []string
+	err = c.Poll(context.Background(), fmt.Sprintf("http://localhost:%d", port), func(resp *http.Response) error {
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		bodies = append(bodies, string(b))
+		if len(bodies) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("got error %v, want the handler's error", err)
+	}
+	if want := "[call 2 call 4]"; fmt.Sprint(bodies) != want {
+		t.Errorf("got bodies %v, want %v", bodies, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := "[1 2 1]"; fmt.Sprint(waits) != want {
+		t.Errorf("got backoff indexes %v, want %v reset after each success", waits, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Poll(ctx, fmt.Sprintf("http://localhost:%d", port), func(*http.Response) error { return nil }); err != context.Canceled {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+}
+
+func TestPollMinInterval(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		status := http.StatusOK
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			status = http.StatusServiceUnavailable
+		}
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})})
+	c.MaxRetries = 1
+	// a negative backoff is clamped, and raised to MinInterval, like between attempts
+	c.Backoff = func(_ int) time.Duration { return -time.Second }
+	c.MinInterval = 30 * time.Millisecond
+
+	stop := errors.New("stop")
+	start := time.Now()
+	err := c.Poll(context.Background(), "http://example.com", func(resp *http.Response) error {
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("got error %v, want %v", err, stop)
+	}
+	if took := time.Since(start); took < 60*time.Millisecond {
+		t.Errorf("took %s, want at least two waits of MinInterval", took)
+	}
+}
+
+func TestCancelStopsAllConcurrentRequests(t *testing.T) {
+	t.Parallel()
+
+	var started, stopped int32
+	allStarted := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&started, 1) == 5 {
+			close(allStarted)
+		}
+		select {
+		case <-r.Context().Done():
+			atomic.AddInt32(&stopped, 1)
+		case <-release:
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.Concurrency = 5
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d", port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-allStarted
+		cancel()
+	}()
+
+	if _, err := c.Do(req.WithContext(ctx)); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after the request was cancelled")
+	}
+
+	if got := atomic.LoadInt32(&started); got != 5 {
+		t.Errorf("got %d requests, want 5 with no retries after cancelling", got)
+	}
+	// the server notices the closed connections asynchronously
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&stopped) != 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&stopped); got != 5 {
+		t.Errorf("got %d requests cancelled on the server, want all 5", got)
+	}
+}
+
+func TestChunkedRequestStaysChunkedOnRetry(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var encodings []string
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		encodings = append(encodings, fmt.Sprintf("%v %d %s", r.TransferEncoding, r.ContentLength, b))
+		mu.Unlock()
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	for _, maxBodyMemory := range []int64{0, 2} {
+		mu.Lock()
+		encodings = nil
+		mu.Unlock()
+		atomic.StoreInt32(&calls, 0)
+
+		c := New()
+		c.MaxRetries = 2
+		c.Backoff = func(_ int) time.Duration { return 0 }
+		c.MaxBodyMemory = maxBodyMemory
+
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://localhost:%d", port), strings.NewReader("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp.Body.Close()
+
+		mu.Lock()
+		if got, want := fmt.Sprint(encodings), "[[chunked] -1 data [chunked] -1 data]"; got != want {
+			t.Errorf("MaxBodyMemory %d: got requests %s, want %s", maxBodyMemory, got, want)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestOnOutcome(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case atomic.AddInt32(&calls, 1) <= 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	var outcomes []string
+	c := New()
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.OnOutcome = func(finalStatus int, attempts int, succeeded bool) {
+		outcomes = append(outcomes, fmt.Sprint(finalStatus, attempts, succeeded))
+	}
+
+	for _, u := range []string{
+		fmt.Sprintf("http://localhost:%d", port),
+		fmt.Sprintf("http://localhost:%d/missing", port),
+		"http://localhost:1",
+	} {
+		if resp, err := c.Get(u); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	if got, want := fmt.Sprint(outcomes), "[200 3 true 404 1 false 0 3 false]"; got != want {
+		t.Errorf("got outcomes %s, want %s", got, want)
+	}
+}
+
+func TestTreatRedirectRetryAfterAsBackoff(t *testing.T) {
+	t.Parallel()
+
+	var calls, slowDowns int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-down" {
+			atomic.AddInt32(&slowDowns, 1)
+			return
+		}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			http.Redirect(w, r, "/slow-down", http.StatusFound)
+			return
+		}
+		w.Write([]byte("data"))
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	var backoffs int32
+	c := New()
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration {
+		atomic.AddInt32(&backoffs, 1)
+		return 0
+	}
+	c.TreatRedirectRetryAfterAsBackoff = true
+
+	resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "data" {
+		t.Errorf("got body %q, want the retried response", b)
+	}
+	if got := atomic.LoadInt32(&slowDowns); got != 0 {
+		t.Errorf("got %d requests to the redirect target, want none", got)
+	}
+	if got := atomic.LoadInt32(&backoffs); got != 0 {
+		t.Errorf("got %d Backoff calls, want the wait to come from Retry-After", got)
+	}
+
+	if wait, ok := parseRetryAfter("120"); !ok || wait != 2*time.Minute {
+		t.Errorf("got %s, %v, want 2m0s", wait, ok)
+	}
+	if wait, ok := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)); !ok || wait < 59*time.Minute {
+		t.Errorf("got %s, %v, want about an hour", wait, ok)
+	}
+	if _, ok := parseRetryAfter("soon"); ok {
+		t.Error("expected an unparsable Retry-After to be ignored")
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	var mu sync.Mutex
+	var bodies []string
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("data"))
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	var redirects int32
+	c := New()
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	hc := &http.Client{
+		Transport: c.RoundTripper(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			atomic.AddInt32(&redirects, 1)
+			return nil
+		},
+	}
+
+	resp, err := hc.Post(fmt.Sprintf("http://localhost:%d", port), "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "data" {
+		t.Errorf("got body %q, want the retried response", b)
+	}
+	mu.Lock()
+	if got, want := fmt.Sprint(bodies), "[payload payload payload]"; got != want {
+		t.Errorf("got request bodies %s, want %s", got, want)
+	}
+	mu.Unlock()
+
+	// redirects are followed by the http.Client, not by pester
+	resp, err = hc.Get(fmt.Sprintf("http://localhost:%d/moved", port))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if got := atomic.LoadInt32(&redirects); got != 1 {
+		t.Errorf("got %d redirects seen by the http.Client, want 1", got)
+	}
+
+	_, err = hc.Get("http://localhost:1")
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) || strings.Count(err.Error(), "localhost:1") != 1 {
+		t.Errorf("got error %v, want a single url.Error", err)
+	}
+}
+
+func TestMaxTotalBodyBuffer(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	first := make(chan struct{})
+	release := make(chan struct{})
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(first)
+			<-release
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxTotalBodyBuffer = 10
+	post := func(ctx context.Context) error {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d", port), strings.NewReader("12345678"))
+		if err != nil {
+			return err
+		}
+		resp, err := c.Do(req.WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- post(context.Background()) }()
+	<-first
+
+	// the first body holds 8 of the 10 bytes until its call is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := post(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want context.DeadlineExceeded while the budget is used", err)
+	}
+
+	go func() { errs <- post(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("got %d calls, want the second body to wait for the budget", got)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	c.Wait()
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("got %d calls, want 2", got)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.bodyBuffered != 0 {
+		t.Errorf("got %d bytes still reserved, want 0", c.bodyBuffered)
+	}
+}
+
+// lenReader is a bytes.Buffer that counts its reads
+type lenReader struct {
+	*bytes.Buffer
+	reads int32
+}
+
+func (r *lenReader) Read(p []byte) (int, error) {
+	atomic.AddInt32(&r.reads, 1)
+	return r.Buffer.Read(p)
+}
+
+func TestMaxTotalBodyBufferPost(t *testing.T) {
+	t.Parallel()
+
+	first := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(first)
+			<-release
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxTotalBodyBuffer = 10
+	url := fmt.Sprintf("http://localhost:%d", port)
+
+	errs := make(chan error, 2)
+	post := func(body io.Reader) {
+		resp, err := c.Post(url, "text/plain", body)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errs <- err
+	}
+	go post(bytes.NewBufferString("12345678"))
+	<-first
+
+	// the size of the second body is known without reading it, so it is not read until the
+	// first body is released
+	second := &lenReader{Buffer: bytes.NewBufferString("12345678")}
+	go post(second)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&second.reads); got != 0 {
+		t.Errorf("got %d reads of the second body, want it to wait for the budget", got)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("got %d calls, want 2", got)
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var hosts []string
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		mu.Unlock()
+		if atomic.AddInt32(&calls, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.HostHeader = "api.example.com"
+
+	u := fmt.Sprintf("http://127.0.0.1:%d", port)
+	resp, err := c.Get(u)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	resp, err = c.Post(u, "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if req.Host != fmt.Sprintf("127.0.0.1:%d", port) {
+		t.Errorf("got caller's request Host %q, want it left alone", req.Host)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hosts) != 6 {
+		t.Fatalf("got %d requests, want 6", len(hosts))
+	}
+	for _, h := range hosts {
+		if h != "api.example.com" {
+			t.Errorf("got Host %q, want api.example.com on every attempt", h)
+		}
+	}
+}
+
+func TestNegativeBackoffClamped(t *testing.T) {
+	t.Parallel()
+
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxRetries = 3
+	c.KeepLog = true
+	c.Backoff = func(_ int) time.Duration { return -time.Hour }
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if got := strings.Count(c.LogString(), "negative backoff of -1h0m0s"); got != 1 {
+		t.Errorf("got %d negative backoff warnings, want 1\n%s", got, c.LogString())
+	}
+}
+
+func TestNoRetryHeader(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	var leaked int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("X-Pester-No-Retry") != "" {
+			atomic.AddInt32(&leaked, 1)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.Concurrency = 1
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.NoRetryHeader = "X-Pester-No-Retry"
+
+	tests := []struct {
+		value     string
+		wantCalls int32
+	}{
+		{"true", 1},
+		{"false", 3},
+		{"", 3},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&calls, 0)
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d", port), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.value != "" {
+			req.Header.Set("X-Pester-No-Retry", tt.value)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp.Body.Close()
+		c.Wait()
+		if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+			t.Errorf("header %q: got %d calls, want %d", tt.value, got, tt.wantCalls)
+		}
+		if tt.value == "true" && req.Header.Get("X-Pester-No-Retry") != "true" {
+			t.Error("expected the caller's request to keep its header")
+		}
+	}
+	if got := atomic.LoadInt32(&leaked); got != 0 {
+		t.Errorf("got %d requests sent with the header, want it removed", got)
+	}
+}
+
+func TestWaitContext(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 2)
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.Concurrency = 2
+	c.MaxRetries = 1
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	// wait for a request to be in flight
+	<-arrived
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.WaitContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want context.DeadlineExceeded while requests are in flight", err)
+	}
+
+	close(release)
+	<-done
+	if err := c.WaitContext(context.Background()); err != nil {
+		t.Errorf("got %v, want nil once the requests are done", err)
+	}
+}
+
+func TestCheckRedirectErrorsAreRetried(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/target" {
+			w.Write([]byte("data"))
+			return
+		}
+		atomic.AddInt32(&calls, 1)
+		http.Redirect(w, r, "/target", http.StatusFound)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	errUnavailable := errors.New("redirect target temporarily unavailable")
+	var checks int32
+	c := NewExtendedClient(&http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if atomic.AddInt32(&checks, 1) <= 2 {
+				return errUnavailable
+			}
+			return nil
+		},
+	})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "data" {
+		t.Errorf("got body %q, want the redirect target", b)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("got %d calls, want the redirect error retried twice", got)
+	}
+
+	// the redirect error reaches ShouldContinue like any other error
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&checks, 0)
+	c.ShouldContinue = func(_ int, _ time.Duration, _ *http.Response, err error) (bool, time.Duration) {
+		return err != nil && !errors.Is(err, errUnavailable), 0
+	}
+	if _, err := c.Get(fmt.Sprintf("http://localhost:%d", port)); !errors.Is(err, errUnavailable) {
+		t.Errorf("got error %v, want the CheckRedirect error", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("got %d calls, want 1 when ShouldContinue does not retry the redirect error", got)
+	}
+}
+
+func TestRequestBuilder(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	var mu sync.Mutex
+	var got []string
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, fmt.Sprintf("%s %s %s %s %s", r.Method, r.URL.RequestURI(), r.Header.Get("Content-Type"), r.Header.Get("X-Token"), b))
+		mu.Unlock()
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	resp, err := c.NewRequest(http.MethodPut, fmt.Sprintf("http://localhost:%d/items?a=1", port)).
+		Header("X-Token", "secret").
+		Query("b", "2").
+		JSON(map[string]int{"n": 1}).
+		Do(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	want := `PUT /items?a=1&b=2 application/json secret {"n":1}`
+	mu.Lock()
+	if len(got) != 2 || got[0] != want || got[1] != want {
+		t.Errorf("got requests %q, want %q retried once", got, want)
+	}
+	mu.Unlock()
+
+	if _, err := c.NewRequest(http.MethodPost, "http://localhost:1").JSON(make(chan int)).Do(context.Background()); err == nil {
+		t.Error("expected the JSON encoding error")
+	}
+}
+
+func TestOnConnReuse(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	var mu sync.Mutex
+	var conns []string
+	c := NewExtendedClient(&http.Client{Transport: &http.Transport{}})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.OnConnReuse = func(attempt int, reused bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		conns = append(conns, fmt.Sprint(attempt, reused))
+	}
+
+	resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	// the retries reuse the connection of the first attempt, whose body was closed
+	if got, want := fmt.Sprint(conns), "[1 false 2 true 3 true]"; got != want {
+		t.Errorf("got connections %s, want %s", got, want)
+	}
+}
+
+func TestMinInterval(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var times []time.Time
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.MinInterval = 50 * time.Millisecond
+
+	resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	if len(times) != 3 {
+		t.Fatalf("got %d requests, want 3", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < c.MinInterval {
+			t.Errorf("got %s between attempts %d and %d, want at least %s", gap, i, i+1, c.MinInterval)
+		}
+	}
+	mu.Unlock()
+
+	// the wait can still be cancelled
+	c.MinInterval = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d", port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := c.Do(req.WithContext(ctx)); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("got %s for a cancelled wait, want it to stop early", elapsed)
+	}
+}
+
+func TestBodyChecksumHeader(t *testing.T) {
+	t.Parallel()
+
+	var calls, verified int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		sum := sha256.Sum256(b)
+		if r.Header.Get("X-Content-SHA256") == hex.EncodeToString(sum[:]) {
+			atomic.AddInt32(&verified, 1)
+		}
+		if atomic.AddInt32(&calls, 1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	for _, maxBodyMemory := range []int64{0, 4} {
+		c := New()
+		c.MaxRetries = 2
+		c.Backoff = func(_ int) time.Duration { return 0 }
+		c.BodyChecksumHeader = "X-Content-SHA256"
+		c.MaxBodyMemory = maxBodyMemory
+
+		resp, err := c.Post(fmt.Sprintf("http://localhost:%d", port), "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp.Body.Close()
+
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://localhost:%d", port), strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err = c.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp.Body.Close()
+		if req.Header.Get("X-Content-SHA256") != "" {
+			t.Error("expected the caller's request to be left alone")
+		}
+	}
+	if got := atomic.LoadInt32(&verified); got != 8 {
+		t.Errorf("got %d attempts with a valid checksum, want 8", got)
+	}
+
+	// a replay that differs from the checksummed body fails to be read
+	bodies := []string{"payload", "changed"}
+	getBody := func() (io.ReadCloser, error) {
+		b := bodies[0]
+		bodies = bodies[1:]
+		return ioutil.NopCloser(strings.NewReader(b)), nil
+	}
+	sum, err := bodyChecksum(getBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := checksumBody(getBody, sum)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(body); err != ErrBodyChecksumMismatch {
+		t.Errorf("got error %v, want ErrBodyChecksumMismatch", err)
+	}
+}
+
+func TestFastWinnerReturnsWithoutWaitingForLosers(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&calls, 1) > 1 {
+				// a loser that does not notice it was cancelled
+				time.Sleep(500 * time.Millisecond)
+			} else {
+				// let the losers be sent before winning
+				for atomic.LoadInt32(&calls) < 4 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok")), Request: r}, nil
+		}),
+	})
+	c.Concurrency = 4
+	c.MaxRetries = 1
+
+	start := time.Now()
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("got %s to return, want the fast winner returned right away", elapsed)
+	}
+
+	// only Wait waits for the losers, whose late responses are closed
+	c.Wait()
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Wait returned after %s, before the losers were back", elapsed)
+	}
+	if got := atomic.LoadInt32(&c.completedLosers); got != 3 {
+		t.Errorf("got %d late responses drained, want 3", got)
+	}
+}
+
+func TestBackoffHooks(t *testing.T) {
+	t.Parallel()
+
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	var mu sync.Mutex
+	var events []string
+	c := New()
+	c.MaxRetries = 3
+	c.Backoff = func(i int) time.Duration { return time.Duration(i) * time.Millisecond }
+	c.OnBackoffStart = func(attempt int, d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf("start %d %s", attempt, d))
+	}
+	c.OnBackoffEnd = func(attempt int, interrupted bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf("end %d %v", attempt, interrupted))
+	}
+
+	resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	if got, want := fmt.Sprint(events), "[start 1 1ms end 1 false start 2 2ms end 2 false]"; got != want {
+		t.Errorf("got events %s, want %s", got, want)
+	}
+	events = nil
+	mu.Unlock()
+
+	c.Backoff = func(_ int) time.Duration { return time.Hour }
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d", port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(req.WithContext(ctx)); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, want context.DeadlineExceeded", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := fmt.Sprint(events), "[start 1 1h0m0s end 1 true]"; got != want {
+		t.Errorf("got events %s, want %s", got, want)
+	}
+}
+
+func TestMaxTotalAttempts(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(5 * time.Millisecond)
+			return nil, errors.New("connection refused")
+		}),
+	})
+	c.Concurrency = 5
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.MaxTotalAttempts = 7
+
+	if _, err := c.Get("http://example.com"); err == nil {
+		t.Fatal("expected error")
+	}
+	c.Wait()
+	if got := atomic.LoadInt32(&calls); got > 7 {
+		t.Errorf("got %d attempts, want at most MaxTotalAttempts of 7 instead of 15", got)
+	}
+
+	// fewer attempts than concurrent requests
+	atomic.StoreInt32(&calls, 0)
+	c.MaxTotalAttempts = 2
+	if _, err := c.Get("http://example.com"); err == nil {
+		t.Fatal("expected error")
+	}
+	c.Wait()
+	if got := atomic.LoadInt32(&calls); got > 2 {
+		t.Errorf("got %d attempts, want at most 2", got)
+	}
+
+	// the attempts that don't count towards MaxRetries still count towards MaxTotalAttempts
+	fallbacks := []struct {
+		name   string
+		resp   func() *http.Response
+		config func(c *Client)
+	}{
+		{
+			name: "identity fallback",
+			resp: func() *http.Response {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Encoding": {"gzip"}}, Body: ioutil.NopCloser(strings.NewReader("not gzip"))}
+			},
+			config: func(c *Client) { c.RetryIdentityOnGzipError = true },
+		},
+		{
+			name: "unauthorized refresh",
+			resp: func() *http.Response {
+				return &http.Response{StatusCode: http.StatusUnauthorized, Body: ioutil.NopCloser(strings.NewReader(""))}
+			},
+			config: func(c *Client) { c.OnUnauthorized = func(*http.Request) error { return nil } },
+		},
+	}
+	for _, tt := range fallbacks {
+		var calls int32
+		c := NewExtendedClient(&http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				atomic.AddInt32(&calls, 1)
+				resp := tt.resp()
+				resp.Request = r
+				return resp, nil
+			}),
+		})
+		c.MaxRetries = 3
+		c.Backoff = func(_ int) time.Duration { return 0 }
+		c.MaxTotalAttempts = 1
+		tt.config(c)
+
+		resp, err := c.Get("http://example.com")
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if got := atomic.LoadInt32(&calls); got != 1 {
+			t.Errorf("%s: got %d attempts, want 1", tt.name, got)
+		}
+	}
+}
+
+func TestMaxTotalAttemptsWithSelectBest(t *testing.T) {
+	t.Parallel()
+
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	})
+	c.Concurrency = 3
+	c.MaxTotalAttempts = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	var results int
+	c.SelectBest = func(best []Result) int {
+		results = len(best)
+		return 0
+	}
+
+	// the request over MaxTotalAttempts sends no result, which must not be waited for
+	done := make(chan error, 1)
+	go func() {
+		resp, err := c.Get("http://example.com")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the call never returned")
+	}
+	if results != 2 {
+		t.Errorf("got %d results for SelectBest, want 2", results)
+	}
+}
+
+func TestMetadataFromContext(t *testing.T) {
+	t.Parallel()
+
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	type tenantKey struct{}
+	var hooked []map[string]string
+	c := New()
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.KeepLog = true
+	c.MetadataFromContext = func(ctx context.Context) map[string]string {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		return map[string]string{"tenant": tenant}
+	}
+	c.ContextLogHook = func(_ context.Context, e ErrEntry) {
+		hooked = append(hooked, e.Metadata)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d", port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req.WithContext(context.WithValue(context.Background(), tenantKey{}, "acme")))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	if len(c.ErrLog) != 2 {
+		t.Fatalf("got %d log entries, want 2", len(c.ErrLog))
+	}
+	for _, e := range c.ErrLog {
+		if e.Metadata["tenant"] != "acme" {
+			t.Errorf("got metadata %v, want the tenant from the context", e.Metadata)
+		}
+	}
+	if len(hooked) != 2 || hooked[0]["tenant"] != "acme" {
+		t.Errorf("got hooked metadata %v, want it in the entries passed to ContextLogHook", hooked)
+	}
+}
+
+func TestRegisterDecoder(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "x-base64")
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Write([]byte("!!not base64!!"))
+			return
+		}
+		w.Write([]byte(base64.StdEncoding.EncodeToString([]byte("data"))))
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.RegisterDecoder("X-Base64", func(r io.Reader) io.Reader {
+		return base64.NewDecoder(base64.StdEncoding, r)
+	})
+
+	b, status, err := c.GetBytes(fmt.Sprintf("http://localhost:%d", port))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if status != http.StatusOK || string(b) != "data" {
+		t.Errorf("got %d %q, want the decoded body", status, b)
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("got %d calls, want the undecodable body retried", got)
+	}
+}
+
+func TestFatalStatusCodes(t *testing.T) {
+	t.Parallel()
+
+	for _, selectBest := range []bool{false, true} {
+		var calls int32
+		c := NewExtendedClient(&http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					return &http.Response{StatusCode: http.StatusUnauthorized, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+				}
+				select {
+				case <-time.After(5 * time.Second):
+					return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+				case <-r.Context().Done():
+					return nil, r.Context().Err()
+				}
+			}),
+		})
+		c.Concurrency = 3
+		c.MaxRetries = 3
+		c.FatalStatusCodes = []int{http.StatusUnauthorized}
+		// retrying everything would otherwise retry the 401
+		c.ShouldContinue = func(_ int, _ time.Duration, _ *http.Response, _ error) (bool, time.Duration) {
+			return true, 0
+		}
+		if selectBest {
+			c.SelectBest = func(results []Result) int { return 0 }
+		}
+
+		start := time.Now()
+		resp, err := c.Get("http://example.com")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp.Body.Close()
+		c.Wait()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("SelectBest %v: got status %d, want 401", selectBest, resp.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("SelectBest %v: took %s, want the other requests cancelled", selectBest, elapsed)
+		}
+		if got := atomic.LoadInt32(&calls); got > 3 {
+			t.Errorf("SelectBest %v: got %d calls, want the 401 not retried", selectBest, got)
+		}
+	}
+}
+
+func TestOnAttemptResponse(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var backends []string
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		backends = append(backends, r.Header.Get("X-Backend"))
+		mu.Unlock()
+		w.Header().Set("X-Backend", "b"+strconv.Itoa(int(atomic.AddInt32(&calls, 1))))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.OnAttemptResponse = func(resp *http.Response, nextReq *http.Request) {
+		nextReq.Header.Set("X-Backend", resp.Header.Get("X-Backend"))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d", port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := fmt.Sprint(backends), "[ b1 b2]"; got != want {
+		t.Errorf("got X-Backend headers %s, want %s", got, want)
+	}
+	if got := req.Header.Get("X-Backend"); got != "" {
+		t.Errorf("got X-Backend %q on the caller's request, want it left alone", got)
+	}
+}
+
+func TestAggregateConcurrentErrors(t *testing.T) {
+	t.Parallel()
+
+	errTimeout := errors.New("upstream timeout")
+	var calls int32
+	c := NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			switch atomic.AddInt32(&calls, 1) {
+			case 1:
+				return nil, errors.New("connection reset by peer")
+			case 2:
+				time.Sleep(20 * time.Millisecond)
+				return nil, errTimeout
+			default:
+				time.Sleep(40 * time.Millisecond)
+				return nil, errors.New("no route to host")
+			}
+		}),
+	})
+	c.Concurrency = 3
+	c.MaxRetries = 1
+	c.AggregateConcurrentErrors = true
+
+	_, err := c.Get("http://example.com")
+	var multi MultiError
+	if !errors.As(err, &multi) {
+		t.Fatalf("got error %v, want a MultiError", err)
+	}
+	if len(multi) != 3 {
+		t.Errorf("got %d errors, want the errors of all 3 requests: %v", len(multi), err)
+	}
+	if !errors.Is(err, errTimeout) {
+		t.Errorf("got error %v, want it to wrap each error", err)
+	}
+
+	// a request that succeeds after the first failure is returned instead
+	atomic.StoreInt32(&calls, 0)
+	c = NewExtendedClient(&http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return nil, errors.New("connection reset by peer")
+			}
+			time.Sleep(20 * time.Millisecond)
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok")), Request: r}, nil
+		}),
+	})
+	c.Concurrency = 3
+	c.MaxRetries = 1
+	c.AggregateConcurrentErrors = true
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	c.Wait()
+}
+
+func TestBudgetAwareBackoff(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" || atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(50 * time.Millisecond)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 10 * time.Second }
+	c.BudgetAwareBackoff = true
+
+	get := func(path string, timeout time.Duration) (*http.Response, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.Do(req.WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	// the backoff is shortened to fit the retry before the deadline
+	start := time.Now()
+	resp, err := get("/", 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want the retry to succeed", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("took %s, want the retry before the deadline", elapsed)
+	}
+
+	// no retry fits, so the last response is returned without waiting for the deadline
+	start = time.Now()
+	resp, err = get("/slow", 80*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want the last response", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed >= 80*time.Millisecond {
+		t.Errorf("took %s, want to give up before the deadline", elapsed)
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	var mu sync.Mutex
+	var lastEventIDs []string
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			fmt.Fprint(w, ": keep-alive\n\nid: 1\ndata: first\n\nid: 2\nevent: update\ndata: second\ndata: line\n\n")
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, "id: 3\r\ndata: third\r\n\r\n")
+		}
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	c := New()
+	c.MaxRetries = 1
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var events []Event
+	err = c.StreamSSE(ctx, fmt.Sprintf("http://localhost:%d", port), func(e Event) {
+		events = append(events, e)
+		if len(events) == 3 {
+			cancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+
+	want := "[{1  first 0s} {2 update second\nline 0s} {3  third 0s}]"
+	if got := fmt.Sprint(events); got != want {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := fmt.Sprint(lastEventIDs); got != "[ 2 2]" {
+		t.Errorf("got Last-Event-IDs %q, want %q", got, "[ 2 2]")
+	}
+}
+
+func TestStreamSSEStops(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		status  int
+		wantErr string
+	}{
+		{http.StatusNoContent, ErrStreamEnded.Error()},
+		{http.StatusUnauthorized, (&StatusError{StatusCode: http.StatusUnauthorized}).Error()},
+		{http.StatusNotFound, (&StatusError{StatusCode: http.StatusNotFound}).Error()},
+	}
+	for _, tt := range tests {
+		var calls int32
+		c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			return &http.Response{StatusCode: tt.status, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		})})
+		c.MaxRetries = 1
+		c.Backoff = func(_ int) time.Duration { return 0 }
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := c.StreamSSE(ctx, "http://example.com", func(e Event) {})
+		cancel()
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("status %d: got error %v, want %s", tt.status, err, tt.wantErr)
+		}
+		if got := atomic.LoadInt32(&calls); got != 1 {
+			t.Errorf("status %d: got %d calls, want no reconnection", tt.status, got)
+		}
+	}
+}
+
+func TestAutoReadWinningBody(t *testing.T) {
+	t.Parallel()
+
+	for _, autoRead := range []bool{false, true} {
+		body := &closeCountingBody{Reader: strings.NewReader("data")}
+		c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Body: body, Request: r}, nil
+		})})
+		c.AutoReadWinningBody = autoRead
+
+		resp, err := c.Get("http://example.com")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// the body is closed before the caller gets to it only when it was read into memory
+		want := int32(0)
+		if autoRead {
+			want = 1
+		}
+		if got := body.Closes(); got != want {
+			t.Errorf("autoRead %t: got %d closes before reading, want %d", autoRead, got, want)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "data" {
+			t.Errorf("autoRead %t: got body %q, want %q", autoRead, b, "data")
+		}
+	}
+}
+
+func TestRetryableGRPCCodes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		trailer   bool
+		status    string
+		wantCalls int32
+	}{
+		{"unavailable header", false, "14", 3},
+		{"unavailable trailer", true, "14", 3},
+		{"not found header", false, "5", 1},
+		{"ok trailer", true, "0", 1},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+			port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				if tt.trailer {
+					w.Header().Set("Trailer", "Grpc-Status")
+					w.Write([]byte("message"))
+					w.Header().Set("Grpc-Status", tt.status)
+					return
+				}
+				w.Header().Set("Grpc-Status", tt.status)
+				w.Write([]byte("message"))
+			}))
+			if err != nil {
+				t.Fatal("unable to start server", err)
+			}
+			defer closeFn()
+
+			c := New()
+			c.MaxRetries = 3
+			c.Backoff = func(_ int) time.Duration { return 0 }
+			c.GRPCStatusHeader = "Grpc-Status"
+			c.RetryableGRPCCodes = []int{14, 8}
+
+			resp, err := c.Get(fmt.Sprintf("http://localhost:%d", port))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if string(b) != "message" {
+				t.Errorf("got body %q, want %q", b, "message")
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	var defaultCalls, overrideCalls int32
+	c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&defaultCalls, 1)
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	override := &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&overrideCalls, 1)
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})}
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req.WithContext(WithHTTPClient(context.Background(), override)))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	// the override gets every attempt, retried with the client's options
+	if got := atomic.LoadInt32(&overrideCalls); got != 3 {
+		t.Errorf("got %d calls to the override, want 3", got)
+	}
+
+	resp, err = c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+	if got := atomic.LoadInt32(&defaultCalls); got != 1 {
+		t.Errorf("got %d calls to the client's http.Client, want 1", got)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	permanent := errors.New("permanent")
+	temporary := errors.New("temporary")
+	tests := []struct {
+		name         string
+		errs         []error
+		wantErr      error
+		wantAttempts []int
+	}{
+		{"succeeds after retries", []error{temporary, temporary, nil}, nil, []int{1, 2, 3}},
+		{"retries run out", []error{temporary, temporary, temporary, nil}, temporary, []int{1, 2, 3}},
+		{"not retryable", []error{permanent, nil}, permanent, []int{1}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var waits []int
+			c := New()
+			c.KeepLog = true
+			c.MaxRetries = 3
+			c.Backoff = func(retry int) time.Duration {
+				waits = append(waits, retry)
+				return 0
+			}
+			c.RetryableError = func(err error) bool { return err != permanent }
+
+			var attempts []int
+			err := c.Retry(context.Background(), func(attempt int) error {
+				attempts = append(attempts, attempt)
+				return tt.errs[attempt-1]
+			})
+			if err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if got, want := fmt.Sprint(attempts), fmt.Sprint(tt.wantAttempts); got != want {
+				t.Errorf("got attempts %s, want %s", got, want)
+			}
+			if got, want := len(waits), len(tt.wantAttempts)-1; got != want {
+				t.Errorf("got %d waits, want %d", got, want)
+			}
+			failed := 0
+			for _, attempt := range attempts {
+				if tt.errs[attempt-1] != nil {
+					failed++
+				}
+			}
+			if got := c.LogErrCount(); got != failed {
+				t.Errorf("got %d log entries, want %d", got, failed)
+			}
+		})
+	}
+
+	t.Run("cancelled during backoff", func(t *testing.T) {
+		t.Parallel()
+
+		c := New()
+		c.MaxRetries = 3
+		c.Backoff = func(_ int) time.Duration { return time.Hour }
+
+		ctx, cancel := context.WithCancel(context.Background())
+		calls := 0
+		err := c.Retry(ctx, func(_ int) error {
+			calls++
+			cancel()
+			return temporary
+		})
+		if err != context.Canceled {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+		if calls != 1 {
+			t.Errorf("got %d calls, want 1", calls)
+		}
+	})
+}
+
+func TestCloseConnectionBetweenRetries(t *testing.T) {
+	t.Parallel()
+
+	for _, closeConn := range []bool{false, true} {
+		var closes []bool
+		c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			closes = append(closes, r.Close)
+			return &http.Response{StatusCode: http.StatusBadGateway, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		})})
+		c.MaxRetries = 3
+		c.Backoff = func(_ int) time.Duration { return 0 }
+		c.CloseConnectionBetweenRetries = closeConn
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp.Body.Close()
+
+		want := fmt.Sprint([]bool{false, closeConn, closeConn})
+		if got := fmt.Sprint(closes); got != want {
+			t.Errorf("close %t: got closes %s, want %s", closeConn, got, want)
+		}
+		if req.Close {
+			t.Errorf("close %t: the caller's request was changed", closeConn)
+		}
+	}
+}
+
+// attemptRecorder keeps the attempts it records
+type attemptRecorder struct {
+	mu       sync.Mutex
+	attempts []RecordedAttempt
+}
+
+func (r *attemptRecorder) Record(attempt RecordedAttempt) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts = append(r.attempts, attempt)
+}
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		call := atomic.AddInt32(&calls, 1)
+		status := http.StatusOK
+		if call == 1 {
+			status = http.StatusServiceUnavailable
+		}
+		return &http.Response{StatusCode: status, Header: http.Header{"X-Call": {fmt.Sprint(call)}}, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	recorder := &attemptRecorder{}
+	c.Recorder = recorder
+	c.MaxRecordedBody = 4
+
+	req, err := http.NewRequest(http.MethodPut, "http://example.com/path", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "secret")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.attempts) != 2 {
+		t.Fatalf("got %d recorded attempts, want 2", len(recorder.attempts))
+	}
+	for i, a := range recorder.attempts {
+		if a.Attempt != i+1 || a.Method != http.MethodPut || a.URL != "http://example.com/path" {
+			t.Errorf("attempt %d: got attempt %d %s %s", i+1, a.Attempt, a.Method, a.URL)
+		}
+		if string(a.Body) != "payl" || !a.BodyTruncated {
+			t.Errorf("attempt %d: got body %q, truncated %t, want %q, truncated", i+1, a.Body, a.BodyTruncated, "payl")
+		}
+		if got := a.Header.Get("Authorization"); got != redacted {
+			t.Errorf("attempt %d: got Authorization %q, want it redacted", i+1, got)
+		}
+		if got := a.ResponseHeader.Get("X-Call"); got != fmt.Sprint(i+1) {
+			t.Errorf("attempt %d: got response header %q, want %q", i+1, got, fmt.Sprint(i+1))
+		}
+	}
+	if got := fmt.Sprint(recorder.attempts[0].StatusCode, recorder.attempts[1].StatusCode); got != "503 200" {
+		t.Errorf("got statuses %s, want 503 200", got)
+	}
+}
+
+func TestOnUnauthorized(t *testing.T) {
+	t.Parallel()
+
+	refreshErr := errors.New("refresh failed")
+	tests := []struct {
+		name       string
+		token      string
+		refreshErr error
+		wantStatus int
+		wantErr    error
+		wantCalls  int32
+	}{
+		{"refreshed", "new", nil, http.StatusOK, nil, 2},
+		{"still unauthorized", "expired", nil, http.StatusUnauthorized, nil, 2},
+		{"refresh fails", "new", refreshErr, 0, refreshErr, 1},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls int32
+			c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				atomic.AddInt32(&calls, 1)
+				status := http.StatusUnauthorized
+				if r.Header.Get("Authorization") == "Bearer new" {
+					status = http.StatusOK
+				}
+				return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+			})})
+			c.MaxRetries = 1
+			c.Backoff = func(_ int) time.Duration { return time.Hour }
+			c.OnUnauthorized = func(req *http.Request) error {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+				return tt.refreshErr
+			}
+
+			req, err := http.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer expired")
+			resp, err := c.Do(req)
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if resp != nil {
+				resp.Body.Close()
+				if resp.StatusCode != tt.wantStatus {
+					t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+				}
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("got %d calls, want %d", got, tt.wantCalls)
+			}
+			if got := req.Header.Get("Authorization"); got != "Bearer expired" {
+				t.Errorf("the caller's request was changed, got Authorization %q", got)
+			}
+		})
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	port, closeFn, err := middlewareServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		// three redirects, from /0 to /3
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if n < 3 {
+			http.Redirect(w, r, fmt.Sprintf("/%d", n+1), http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	if err != nil {
+		t.Fatal("unable to start server", err)
+	}
+	defer closeFn()
+
+	tests := []struct {
+		maxRedirects int
+		wantErr      bool
+	}{
+		{2, true},
+		{3, false},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&calls, 0)
+		c := New()
+		c.MaxRetries = 3
+		c.Backoff = func(_ int) time.Duration { return 0 }
+		c.MaxRedirects = tt.maxRedirects
+
+		resp, err := c.Get(fmt.Sprintf("http://localhost:%d/0", port))
+		if tt.wantErr {
+			if !errors.Is(err, ErrTooManyRedirects) {
+				t.Errorf("max %d: got error %v, want %v", tt.maxRedirects, err, ErrTooManyRedirects)
+			}
+		} else if err != nil {
+			t.Errorf("max %d: unexpected error %v", tt.maxRedirects, err)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		// the redirects are followed once, as going over the limit is not retried
+		if got := atomic.LoadInt32(&calls); got != int32(tt.maxRedirects)+1 {
+			t.Errorf("max %d: got %d calls, want %d", tt.maxRedirects, got, tt.maxRedirects+1)
+		}
+	}
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	t.Parallel()
+
+	var slow int32
+	var calls int32
+	c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.CompareAndSwapInt32(&slow, 1, 0) {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+				return nil, r.Context().Err()
+			}
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("data")), Request: r}, nil
+	})})
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.AdaptiveTimeout = true
+	c.AdaptiveTimeoutMultiplier = 10
+	c.KeepLog = true
+
+	// known latencies of the host, for a timeout of 200ms
+	for i := 0; i < adaptiveTimeoutMinSamples; i++ {
+		c.recordLatency("example.com", 20*time.Millisecond)
+	}
+	if got := c.adaptiveTimeout("example.com"); got != 200*time.Millisecond {
+		t.Fatalf("got a timeout of %s, want 200ms", got)
+	}
+	if got := c.adaptiveTimeout("example.org"); got != 0 {
+		t.Errorf("got a timeout of %s for an unknown host, want none", got)
+	}
+
+	atomic.StoreInt32(&slow, 1)
+	start := time.Now()
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if took := time.Since(start); took > 2500*time.Millisecond {
+		t.Errorf("took %s, want the slow attempt to be cut short", took)
+	}
+	if string(b) != "data" {
+		t.Errorf("got body %q, want %q", b, "data")
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("got %d calls, want 2", got)
+	}
+	c.Lock()
+	defer c.Unlock()
+	if len(c.ErrLog) != 1 || !errors.Is(c.ErrLog[0].Err, ErrAdaptiveTimeout) {
+		t.Errorf("got log %v, want one %v", c.ErrLog, ErrAdaptiveTimeout)
+	}
+}
+
+func TestHonorServerConnectionClose(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var closes []bool
+	c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		closes = append(closes, r.Close)
+		// only the first response asks for the connection to be closed
+		return &http.Response{StatusCode: http.StatusOK, Close: len(closes) == 1, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})})
+	c.HonorServerConnectionClose = true
+	c.ServerConnectionCloseWindow = 50 * time.Millisecond
+
+	get := func(url string) {
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp.Body.Close()
+	}
+	get("http://example.com")
+	get("http://example.com")
+	get("http://example.org")
+	time.Sleep(60 * time.Millisecond)
+	get("http://example.com")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := fmt.Sprint(closes), fmt.Sprint([]bool{false, true, false, false}); got != want {
+		t.Errorf("got closes %s, want %s", got, want)
+	}
+}
+
+func TestNoRetryURLPatterns(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})})
+	c.MaxRetries = 3
+	c.Concurrency = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+	c.BaseURL = "http://example.com"
+	c.NoRetryURLPatterns = []*regexp.Regexp{regexp.MustCompile(`^http://example\.com/payments/`)}
+
+	tests := []struct {
+		url     string
+		retried bool
+	}{
+		{"/payments/charge", false},
+		{"http://example.com/payments/refund", false},
+		{"/orders", true},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&calls, 0)
+		resp, err := c.Get(tt.url)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.url, err)
+		}
+		resp.Body.Close()
+		c.Wait()
+		// the concurrent requests stop retrying once one of them is done, so a retried call
+		// makes at least the attempts of a single request
+		got := atomic.LoadInt32(&calls)
+		if tt.retried && got < 3 {
+			t.Errorf("%s: got %d calls, want at least 3", tt.url, got)
+		} else if !tt.retried && got != 1 {
+			t.Errorf("%s: got %d calls, want 1", tt.url, got)
+		}
+	}
+}
+
+func TestResponseLatencyHeader(t *testing.T) {
+	t.Parallel()
+
+	var calls int32
+	c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		// the first attempt is slow and fails, the winning one is fast
+		status := http.StatusOK
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(100 * time.Millisecond)
+			status = http.StatusServiceUnavailable
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})})
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	resp, err := c.Get("http://example.com")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	ms, err := strconv.Atoi(resp.Header.Get(ResponseLatencyHeader))
+	if err != nil {
+		t.Fatalf("got %s %q, want a number", ResponseLatencyHeader, resp.Header.Get(ResponseLatencyHeader))
+	}
+	if ms < 10 || ms >= 100 {
+		t.Errorf("got a latency of %dms, want that of the winning attempt", ms)
+	}
+}
+
+func TestRememberRateLimits(t *testing.T) {
+	t.Parallel()
+
+	c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		status := http.StatusOK
+		if r.URL.Path == "/limited" {
+			status = http.StatusTooManyRequests
+		}
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})})
+	c.MaxRetries = 1
+	c.Backoff = func(_ int) time.Duration { return 100 * time.Millisecond }
+	c.RememberRateLimits = true
+
+	get := func(url string) time.Duration {
+		start := time.Now()
+		resp, err := c.Get(url)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp.Body.Close()
+		return time.Since(start)
+	}
+	if took := get("http://example.com/limited"); took >= 100*time.Millisecond {
+		t.Errorf("first call took %s, want no wait", took)
+	}
+	if took := get("http://example.com/other"); took >= 100*time.Millisecond {
+		t.Errorf("call to another URL took %s, want no wait", took)
+	}
+	if took := get("http://example.com/limited"); took < 90*time.Millisecond {
+		t.Errorf("call to the rate limited URL took %s, want it to wait", took)
+	}
+}
+
+func TestPostFormWith(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var bodies []string
+	var calls int32
+	c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, r.Header.Get("Content-Type")+" "+string(b))
+		mu.Unlock()
+		status := http.StatusOK
+		if atomic.AddInt32(&calls, 1) == 1 {
+			status = http.StatusServiceUnavailable
+		}
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})})
+	c.MaxRetries = 2
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	// the parameters in the order the server wants, rather than sorted
+	encoder := func(data url.Values) string {
+		return "z=" + data.Get("z") + "&a=" + data.Get("a")
+	}
+	resp, err := c.PostFormWith("http://example.com", url.Values{"a": {"1"}, "z": {"2"}}, encoder)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := fmt.Sprint([]string{"application/x-www-form-urlencoded z=2&a=1", "application/x-www-form-urlencoded z=2&a=1"})
+	if got := fmt.Sprint(bodies); got != want {
+		t.Errorf("got bodies %s, want %s", got, want)
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	t.Parallel()
+
+	sent := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+	c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			// block the retry until the test has looked
+			sent <- struct{}{}
+			<-release
+		}
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+	})})
+	c.MaxRetries = 3
+	backingOff := make(chan struct{})
+	c.Backoff = func(retry int) time.Duration {
+		if retry == 2 {
+			close(backingOff)
+			return time.Hour
+		}
+		return 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := c.Do(req.WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-sent
+	if active, waiting := c.InFlight(); active != 1 || waiting != 0 {
+		t.Errorf("while sending, got %d active and %d waiting, want 1 and 0", active, waiting)
+	}
+	close(release)
+
+	<-backingOff
+	deadline := time.Now().Add(time.Second)
+	for {
+		active, waiting := c.InFlight()
+		if active == 0 && waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("in backoff, got %d active and %d waiting, want 0 and 1", active, waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	<-done
+	c.Wait()
+	if active, waiting := c.InFlight(); active != 0 || waiting != 0 {
+		t.Errorf("once done, got %d active and %d waiting, want 0 and 0", active, waiting)
+	}
+}
+
+func TestMaxConcurrentBodySize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		body      string
+		wantCalls int32
+	}{
+		{"small", 3},
+		{"larger than the limit", 1},
+	}
+	for _, tt := range tests {
+		var calls int32
+		allSent := make(chan struct{})
+		c := NewExtendedClient(&http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&calls, 1) == 3 {
+				close(allSent)
+			}
+			// hold the winner back until every concurrent request is sent, if they are
+			select {
+			case <-allSent:
+			case <-time.After(100 * time.Millisecond):
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: r}, nil
+		})})
+		c.Concurrency = 3
+		c.MaxConcurrentBodySize = 10
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("%q: unexpected error %v", tt.body, err)
+		}
+		resp.Body.Close()
+		c.Wait()
+
+		if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+			t.Errorf("%q: got %d calls, want %d", tt.body, got, tt.wantCalls)
+		}
+	}
+}
+
 func withinEpsilon(got, want int64, epslion float64) bool {
 	if want <= int64(epslion*float64(got)) || want >= int64(epslion*float64(got)) {
 		return false
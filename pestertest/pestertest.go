@@ -0,0 +1,117 @@
+// Package pestertest provides utilities for testing how pester clients handle failures.
+package pestertest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Server is an httptest.Server that fails a set number of requests before succeeding
+type Server struct {
+	*httptest.Server
+
+	// requests is accessed atomically
+	requests int32
+}
+
+// FaultServer starts a Server that responds to its first failures requests with status,
+// and to every request after that with a 200 OK. The caller should call Close when done.
+func FaultServer(failures int, status int) *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(atomic.AddInt32(&s.requests, 1)) <= failures {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "%d %s", status, http.StatusText(status))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("200 OK"))
+	}))
+	return s
+}
+
+// Requests returns the number of requests the Server has received
+func (s *Server) Requests() int {
+	return int(atomic.LoadInt32(&s.requests))
+}
+
+// Response is a canned response, or error, returned by a Transport. A StatusCode of 0
+// stands for 200 OK.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+	Err        error
+}
+
+// Transport is an http.RoundTripper returning canned responses in order, for testing
+// retries without a server
+type Transport struct {
+	mu        sync.Mutex
+	responses []Response
+	requests  int
+}
+
+// SequenceTransport returns a Transport whose nth request gets the nth of responses, or
+// its error, and every request after the last one gets the last one again. Use it as the
+// Transport of the http.Client passed to pester.NewExtendedClient.
+func SequenceTransport(responses ...Response) *Transport {
+	return &Transport{responses: append([]Response(nil), responses...)}
+}
+
+// RoundTrip implements http.RoundTripper. Every response gets its own copy of the header
+// and body, and the request body is read and closed.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	t.mu.Lock()
+	r := Response{}
+	if len(t.responses) > 0 {
+		i := t.requests
+		if i >= len(t.responses) {
+			i = len(t.responses) - 1
+		}
+		r = t.responses[i]
+	}
+	t.requests++
+	t.mu.Unlock()
+
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	status := r.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := r.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}, nil
+}
+
+// Requests returns the number of requests the Transport has received
+func (t *Transport) Requests() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.requests
+}
@@ -0,0 +1,91 @@
+package pestertest_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sethgrid/pester"
+	"github.com/sethgrid/pester/pestertest"
+)
+
+func TestFaultServer(t *testing.T) {
+	t.Parallel()
+
+	s := pestertest.FaultServer(2, http.StatusServiceUnavailable)
+	defer s.Close()
+
+	c := pester.New()
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	resp, err := c.Get(s.URL)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := s.Requests(); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestFaultServerExhaustsRetries(t *testing.T) {
+	t.Parallel()
+
+	s := pestertest.FaultServer(5, http.StatusInternalServerError)
+	defer s.Close()
+
+	c := pester.New()
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	resp, err := c.Get(s.URL)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if got := s.Requests(); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestSequenceTransport(t *testing.T) {
+	t.Parallel()
+
+	transport := pestertest.SequenceTransport(
+		pestertest.Response{Err: errors.New("connection reset by peer")},
+		pestertest.Response{StatusCode: http.StatusServiceUnavailable},
+		pestertest.Response{Body: "data", Header: http.Header{"X-Test": {"ok"}}},
+	)
+	c := pester.NewExtendedClient(&http.Client{Transport: transport})
+	c.MaxRetries = 3
+	c.Backoff = func(_ int) time.Duration { return 0 }
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.Post("http://example.com", "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		// the last response is repeated, with its own body
+		if resp.StatusCode != http.StatusOK || string(b) != "data" || resp.Header.Get("X-Test") != "ok" {
+			t.Errorf("got %d %q %v, want the last response", resp.StatusCode, b, resp.Header)
+		}
+	}
+	if got := transport.Requests(); got != 4 {
+		t.Errorf("got %d requests, want 4", got)
+	}
+}